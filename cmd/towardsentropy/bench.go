@@ -0,0 +1,117 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const benchUsage = "bench [flags] <file or directory>..."
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func runBench(args []string) error {
+	fs := newFlagSet("bench", benchUsage)
+	config := addConfigFlags(fs)
+	var dicts stringList
+	fs.Var(&dicts, "dict", "dictionary id, or path to a .dict file, to measure; repeat for several")
+	levels := fs.String("levels", "", "comma separated compression levels, -level or the config when empty")
+	plain := fs.Bool("plain", true, "also measure plain zstd as a baseline")
+	rounds := fs.Int("rounds", 3, "times each file is compressed and decompressed")
+	asJSON := fs.Bool("json", false, "write JSON instead of a table")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected a corpus of files or directories")
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+
+	opts := towardsentropy.MeasureOptions{Rounds: *rounds}
+	if *plain {
+		opts.DictionaryIds = append(opts.DictionaryIds, "")
+	}
+	for _, dict := range dicts {
+		id, err := resolveDictionary(dict)
+		if err != nil {
+			return err
+		}
+		opts.DictionaryIds = append(opts.DictionaryIds, id)
+	}
+	if len(opts.DictionaryIds) == 0 {
+		return fmt.Errorf("nothing to measure, pass -dict or -plain")
+	}
+	for _, level := range strings.FieldsFunc(*levels, func(r rune) bool { return r == ',' }) {
+		n, err := strconv.Atoi(strings.TrimSpace(level))
+		if err != nil {
+			return fmt.Errorf("invalid level %q", level)
+		}
+		opts.Levels = append(opts.Levels, n)
+	}
+
+	corpus := make([][]byte, 0)
+	for _, root := range fs.Args() {
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err == nil {
+				corpus = append(corpus, data)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	results, err := towardsentropy.MeasureDictionaries(corpus, opts)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "dictionary\tlevel\tfiles\tsize\tcompressed\tratio\tcompress MB/s\tdecompress MB/s\tcompress p50\tp99\tdecompress p50\tp99\t")
+	for _, r := range results {
+		id := r.DictionaryId
+		if id == "" {
+			id = "(zstd)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%.4f\t%.1f\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			id, r.Level, r.Files, r.Size, r.CompressedSize, r.Ratio, r.CompressMBps, r.DecompressMBps,
+			roundDuration(r.CompressP50), roundDuration(r.CompressP99), roundDuration(r.DecompressP50), roundDuration(r.DecompressP99))
+	}
+	return w.Flush()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
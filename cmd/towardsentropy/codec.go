@@ -0,0 +1,121 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const (
+	compressUsage   = "compress [flags] [input]"
+	decompressUsage = "decompress [flags] [input]"
+)
+
+func runCompress(args []string) error {
+	fs := newFlagSet("compress", compressUsage)
+	config := addConfigFlags(fs)
+	dict := fs.String("dict", "", "dictionary id, or path to a .dict file; plain zstd when empty")
+	output := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one input")
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+	dictionaryId, err := resolveDictionary(*dict)
+	if err != nil {
+		return err
+	}
+	return transform(fs.Arg(0), *output, func(r io.Reader, w io.Writer) error {
+		return towardsentropy.Compress(r, w, dictionaryId)
+	})
+}
+
+func runDecompress(args []string) error {
+	fs := newFlagSet("decompress", decompressUsage)
+	config := addConfigFlags(fs)
+	dict := fs.String("dict", "", "dictionary id, or path to a .dict file; detected from the frame header when empty")
+	output := fs.String("o", "-", "output file, - for stdout")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one input")
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+	dictionaryId, err := resolveDictionary(*dict)
+	if err != nil {
+		return err
+	}
+	return transform(fs.Arg(0), *output, func(r io.Reader, w io.Writer) error {
+		if dictionaryId == "" {
+			br := bufio.NewReader(r)
+			detected, err := towardsentropy.DetectDictionary(br)
+			if err != nil {
+				return err
+			}
+			dictionaryId, r = detected, br
+		}
+		return towardsentropy.Decompress(r, w, dictionaryId)
+	})
+}
+
+// resolveDictionary loads a dictionary given as a path and returns its id. Any
+// other value is taken to be the id of a dictionary in the dictionary directory.
+func resolveDictionary(value string) (string, error) {
+	if value == "" || !(strings.HasSuffix(value, ".dict") || strings.ContainsRune(value, os.PathSeparator) || strings.Contains(value, "/")) {
+		return value, nil
+	}
+	return towardsentropy.LoadDictionary(value)
+}
+
+// transform runs fn from input to output, where "" and "-" are stdin and
+// stdout. A partly written output file is removed when fn fails.
+func transform(input, output string, fn func(io.Reader, io.Writer) error) error {
+	var r io.Reader = os.Stdin
+	if input != "" && input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	if output == "" || output == "-" {
+		w := bufio.NewWriter(os.Stdout)
+		if err := fn(r, w); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = fn(r, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(output)
+	}
+	return err
+}
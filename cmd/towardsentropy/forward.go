@@ -0,0 +1,37 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const forwardUsage = "forward [flags]"
+
+func runForward(args []string) error {
+	fs := newFlagSet("forward", forwardUsage)
+	config := addConfigFlags(fs)
+	listen := fs.String("listen", "127.0.0.1:3128", "address to listen on")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments")
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+
+	// Clients point HTTP_PROXY at this command, so ignore it to avoid a loop
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.Proxy = nil
+	fmt.Fprintf(os.Stderr, "Forward proxy listening on %s\n", *listen)
+	return http.ListenAndServe(*listen, towardsentropy.NewForwardProxy(base))
+}
@@ -0,0 +1,76 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const inspectUsage = "inspect [flags] [input]"
+
+func runInspect(args []string) error {
+	fs := newFlagSet("inspect", inspectUsage)
+	config := addConfigFlags(fs)
+	asJSON := fs.Bool("json", false, "write JSON instead of a table")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected at most one input")
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if input := fs.Arg(0); input != "" && input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	frames, inspectErr := towardsentropy.InspectFrames(r)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(frames); err != nil {
+			return err
+		}
+		return inspectErr
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "offset\tsize\tmagic\ttype\twindow\tcontent size\tdict id\tdictionary\tchecksum\tblocks")
+	for _, frame := range frames {
+		if frame.Skippable {
+			fmt.Fprintf(w, "%d\t%d\t0x%08X\tskippable\t\t%d\t\t\t\t\n", frame.Offset, frame.Size, frame.Magic, frame.SkippableSize)
+			continue
+		}
+		contentSize := "unknown"
+		if frame.ContentSize >= 0 {
+			contentSize = fmt.Sprint(frame.ContentSize)
+		}
+		dictionary := frame.Dictionary
+		if frame.DictionaryId != 0 && dictionary == "" {
+			dictionary = "(not loaded)"
+		}
+		fmt.Fprintf(w, "%d\t%d\t0x%08X\tzstd\t%d\t%s\t%d\t%s\t%t\t%d\n",
+			frame.Offset, frame.Size, frame.Magic, frame.WindowSize, contentSize, frame.DictionaryId, dictionary, frame.HasChecksum, frame.Blocks)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return inspectErr
+}
@@ -0,0 +1,123 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+// Command towardsentropy works with dictionary compressed files outside of an
+// HTTP server.
+//
+// Usage:
+//
+//	towardsentropy <command> [flags] [arguments]
+//
+// Run "towardsentropy <command> -h" for the flags of a command.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"bench":       {benchUsage, runBench},
+	"compress":    {compressUsage, runCompress},
+	"decompress":  {decompressUsage, runDecompress},
+	"forward":     {forwardUsage, runForward},
+	"inspect":     {inspectUsage, runInspect},
+	"precompress": {precompressUsage, runPrecompress},
+	"proxy":       {proxyUsage, runProxy},
+	"train":       {trainUsage, runTrain},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "towardsentropy: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "towardsentropy %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  towardsentropy %s\n", commands[name].usage)
+	}
+}
+
+// configFlags are the flags shared by commands that load dictionaries.
+type configFlags struct {
+	config       string
+	dictionaries string
+	level        int
+}
+
+func addConfigFlags(fs *flag.FlagSet) *configFlags {
+	c := &configFlags{}
+	fs.StringVar(&c.config, "config", "", "JSON file holding a towardsentropy Config")
+	fs.StringVar(&c.dictionaries, "dictionaries", "", "directory to load dictionaries from, overriding the config")
+	fs.IntVar(&c.level, "level", 0, "zstd compression level, overriding the config")
+	return c
+}
+
+// apply reads the config file, then overrides it with the flags given on the
+// command line.
+func (c *configFlags) apply(fs *flag.FlagSet) error {
+	if c.config != "" {
+		if err := towardsentropy.InitWithJsonFile(c.config); err != nil {
+			return fmt.Errorf("could not read config %s: %v", c.config, err)
+		}
+	}
+	cfg := towardsentropy.Config{}
+	if c.dictionaries != "" {
+		cfg.DictionaryDirectory = towardsentropy.StrPtr(c.dictionaries)
+	}
+	if isSet(fs, "level") {
+		cfg.CompressionLevel = towardsentropy.IntPtr(c.level)
+	}
+	towardsentropy.InitWithStruct(cfg)
+	return nil
+}
+
+// isSet reports whether the named flag was given on the command line.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: towardsentropy %s\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,70 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const precompressUsage = "precompress [flags] <directory>"
+
+func runPrecompress(args []string) error {
+	fs := newFlagSet("precompress", precompressUsage)
+	config := addConfigFlags(fs)
+	frameSize := fs.Int("frame-size", 0, "write seekable siblings with a frame every n bytes, overriding the config")
+	plain := fs.Bool("plain", true, "also write name.zst, compressed without a dictionary")
+	force := fs.Bool("force", false, "compress every file again, ignoring the manifest")
+	manifest := fs.String("manifest", "", "manifest path, "+towardsentropy.DefaultManifestName+" in the directory by default")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one directory")
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+	if isSet(fs, "frame-size") {
+		towardsentropy.InitWithStruct(towardsentropy.Config{FrameSize: frameSize})
+	}
+
+	files, err := towardsentropy.Precompress(fs.Arg(0), towardsentropy.PrecompressOptions{
+		Plain:    *plain,
+		Force:    *force,
+		Manifest: *manifest,
+	})
+	for _, file := range files {
+		fmt.Println(describePrecompressed(file))
+	}
+	return err
+}
+
+func describePrecompressed(file towardsentropy.PrecompressedFile) string {
+	if file.Unchanged {
+		return fmt.Sprintf("%s: unchanged", file.Path)
+	}
+	parts := make([]string, 0, len(file.Siblings)+1)
+	ids := make([]string, 0, len(file.Siblings))
+	for id := range file.Siblings {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		name := id
+		if name == "" {
+			name = "zstd"
+		}
+		parts = append(parts, fmt.Sprintf("%s %d", name, file.Siblings[id]))
+	}
+	for _, id := range file.Rejected {
+		parts = append(parts, fmt.Sprintf("%s rejected", id))
+	}
+	return fmt.Sprintf("%s: %d bytes, plain zstd %d; %s", file.Path, file.Size, file.PlainSize, strings.Join(parts, ", "))
+}
@@ -0,0 +1,53 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const proxyUsage = "proxy [flags] -upstream <url>"
+
+func runProxy(args []string) error {
+	fs := newFlagSet("proxy", proxyUsage)
+	config := addConfigFlags(fs)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	upstream := fs.String("upstream", "", "URL of the service to forward requests to")
+	transcode := fs.Bool("transcode", false, "decode gzip and deflate responses and compress them with a dictionary")
+	gzipRequests := fs.Bool("gzip-requests", false, "forward decompressed request bodies gzip encoded")
+	passthrough := fs.Bool("passthrough", false, "forward compressed request bodies and negotiation headers to an upstream that speaks szstd")
+	fs.Parse(args)
+	if *upstream == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("expected -upstream")
+	}
+	upstreamURL, err := url.Parse(*upstream)
+	if err != nil || upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+		return fmt.Errorf("invalid upstream URL %q", *upstream)
+	}
+	if err := config.apply(fs); err != nil {
+		return err
+	}
+
+	opts := make([]towardsentropy.HandlerOption, 0)
+	if *transcode {
+		opts = append(opts, towardsentropy.WithTranscoding())
+	}
+	if *gzipRequests {
+		opts = append(opts, towardsentropy.WithGzipRequests())
+	}
+	if *passthrough {
+		opts = append(opts, towardsentropy.WithCompressedPassthrough())
+	}
+	fmt.Fprintf(os.Stderr, "Proxying %s to %s\n", *listen, upstreamURL)
+	return http.ListenAndServe(*listen, towardsentropy.NewTowardsEntropyProxy(upstreamURL, opts...))
+}
@@ -0,0 +1,65 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
+)
+
+const trainUsage = "train [flags] <file or directory>..."
+
+func runTrain(args []string) error {
+	fs := newFlagSet("train", trainUsage)
+	output := fs.String("o", "dictionary.dict", "dictionary file to write; its name without .dict is the dictionary id")
+	size := fs.Int("size", towardsentropy.DefaultDictionarySize, "maximum dictionary size in bytes")
+	split := fs.Int("split", 0, "cut each file into samples of this many bytes, like zstd -B; 0 uses whole files")
+	level := fs.Int("level", 0, "compression level to tune the dictionary for, 0 for the zstd default")
+	zstdId := fs.Uint("id", 0, "zstd dictionary id, derived from the contents when 0")
+	threads := fs.Int("threads", runtime.NumCPU(), "threads used to search for training parameters")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected files or directories to train on")
+	}
+
+	samples := make([][]byte, 0)
+	for _, root := range fs.Args() {
+		err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, towardsentropy.SplitSamples(data, *split)...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	dictionary, err := towardsentropy.TrainDictionary(samples, *size,
+		towardsentropy.WithTrainingLevel(*level),
+		towardsentropy.WithZstdId(uint32(*zstdId)),
+		towardsentropy.WithTrainingThreads(*threads),
+	)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, dictionary, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d bytes from %d samples\n", *output, len(dictionary), len(samples))
+	return nil
+}
@@ -9,6 +9,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -33,28 +34,23 @@ func main() {
 }
 
 func Compress(b []byte) {
-	var dictCompressed bytes.Buffer
-	var nonDictCompressed bytes.Buffer
-	dictReader := bytes.NewReader(b)
-	nonDictReader := bytes.NewReader(b)
-
 	// Compress the data with a dictionary
-	err := towardsentropy.Compress(dictReader, &dictCompressed, "supply_chain")
+	dictResult, err := towardsentropy.CompressWithResult(bytes.NewReader(b), io.Discard, "supply_chain")
 	if err != nil {
 		log.Fatalf("Failed to compress data: %v", err)
 	}
 
 	// Compress the data without a dictionary
-	err = towardsentropy.Compress(nonDictReader, &nonDictCompressed, "")
+	nonDictResult, err := towardsentropy.CompressWithResult(bytes.NewReader(b), io.Discard, "")
 	if err != nil {
 		log.Fatalf("Failed to compress data: %v", err)
 	}
 
-	fmt.Printf("Original size:                         %d\n", len(b))
-	fmt.Printf("Compressed size with dictionary:       %d\n", len(dictCompressed.Bytes()))
-	fmt.Printf("Compressed size without dictionary:    %d\n", len(nonDictCompressed.Bytes()))
-	fmt.Printf("Compression ratio with dictionary:     %.2f\n", float64(len(dictCompressed.Bytes()))/float64(len(b)))
-	fmt.Printf("Compression ratio without dictionary:  %.2f\n", float64(len(nonDictCompressed.Bytes()))/float64(len(b)))
+	fmt.Printf("Original size:                         %d\n", dictResult.BytesRead)
+	fmt.Printf("Compressed size with dictionary:       %d\n", dictResult.BytesWritten)
+	fmt.Printf("Compressed size without dictionary:    %d\n", nonDictResult.BytesWritten)
+	fmt.Printf("Compression ratio with dictionary:     %.2f\n", float64(dictResult.BytesWritten)/float64(dictResult.BytesRead))
+	fmt.Printf("Compression ratio without dictionary:  %.2f\n", float64(nonDictResult.BytesWritten)/float64(nonDictResult.BytesRead))
 }
 
 // ListFiles returns a slice of file names from the specified directory path.
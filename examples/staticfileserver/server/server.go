@@ -9,12 +9,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/Towards-Entropy/GoTowardsEntropy/towardsentropy"
 )
 
 func main() {
-	fileServer := http.FileServer(http.Dir("../../../testdata/files"))
+	// Serves precompressed siblings such as file.supply_chain.szst when present
+	fileServer := towardsentropy.NewCompressedFileServer(os.DirFS("../../../testdata/files"))
 
 	// Wrap the file server with the compressing middleware
 	cfg := towardsentropy.Config{
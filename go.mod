@@ -1,5 +1,5 @@
 module github.com/Towards-Entropy/GoTowardsEntropy
 
-go 1.20
+go 1.21
 
 require github.com/DataDog/zstd v1.5.5
@@ -0,0 +1,140 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MeasureOptions configures MeasureDictionaries.
+type MeasureOptions struct {
+	DictionaryIds []string // Dictionaries to measure, "" for plain zstd
+	Levels        []int    // Compression levels, CompressionLevel when empty
+	Rounds        int      // Times each file is compressed and decompressed, at least 1
+}
+
+// DictionaryMeasurement is how one dictionary did on a corpus at one level.
+type DictionaryMeasurement struct {
+	DictionaryId   string        // Dictionary id, "" for plain zstd
+	Level          int           // Compression level
+	Files          int           // Number of files in the corpus
+	Size           int64         // Total size of the files
+	CompressedSize int64         // Total size of the files compressed
+	Ratio          float64       // CompressedSize / Size, smaller is better
+	CompressMBps   float64       // Uncompressed megabytes compressed per second
+	DecompressMBps float64       // Uncompressed megabytes produced per second when decompressing
+	CompressP50    time.Duration // Median time to compress one file
+	CompressP99    time.Duration // 99th percentile time to compress one file
+	DecompressP50  time.Duration // Median time to decompress one file
+	DecompressP99  time.Duration // 99th percentile time to decompress one file
+}
+
+// MeasureDictionaries compresses and decompresses every file in corpus with each
+// dictionary at each level, one file at a time with CompressBytes and
+// DecompressBytes, and reports sizes, throughput and per-file latency. Each
+// dictionary is prepared and run once before timing starts. Results are ordered
+// by dictionary, then level, as given in opts. It fails if a file does not
+// survive the round trip.
+func MeasureDictionaries(corpus [][]byte, opts MeasureOptions) ([]DictionaryMeasurement, error) {
+	levels := opts.Levels
+	if len(levels) == 0 {
+		levels = []int{getConfig().CompressionLevel}
+	}
+	rounds := max(opts.Rounds, 1)
+	var size int64
+	for _, file := range corpus {
+		size += int64(len(file))
+	}
+
+	results := make([]DictionaryMeasurement, 0, len(opts.DictionaryIds)*len(levels))
+	for _, id := range opts.DictionaryIds {
+		for _, level := range levels {
+			result := DictionaryMeasurement{DictionaryId: id, Level: level, Files: len(corpus), Size: size}
+			compressTimes := make([]time.Duration, 0, len(corpus)*rounds)
+			decompressTimes := make([]time.Duration, 0, len(corpus)*rounds)
+			var compressTotal, decompressTotal time.Duration
+			var compressed, decompressed []byte
+
+			// Prepare dictionaries outside the clock, plain zstd needs no preparing
+			if _, err := getCompressor(id, level); err != nil {
+				return nil, err
+			}
+			if _, err := getDecompressor(id); err != nil {
+				return nil, err
+			}
+			if len(corpus) > 0 {
+				var err error
+				if compressed, err = compressBytes(compressed, corpus[0], id, level); err != nil {
+					return nil, err
+				}
+				if decompressed, err = DecompressBytes(decompressed, compressed, id); err != nil {
+					return nil, err
+				}
+			}
+
+			for round := 0; round < rounds; round++ {
+				for i, file := range corpus {
+					var err error
+					start := time.Now()
+					compressed, err = compressBytes(compressed[:0], file, id, level)
+					elapsed := time.Since(start)
+					if err != nil {
+						return nil, err
+					}
+					compressTimes = append(compressTimes, elapsed)
+					compressTotal += elapsed
+
+					start = time.Now()
+					decompressed, err = DecompressBytes(decompressed[:0], compressed, id)
+					elapsed = time.Since(start)
+					if err != nil {
+						return nil, err
+					}
+					decompressTimes = append(decompressTimes, elapsed)
+					decompressTotal += elapsed
+
+					if !bytes.Equal(decompressed, file) {
+						return nil, fmt.Errorf("file %d did not round trip with dictionary '%s' at level %d", i, id, level)
+					}
+					if round == 0 {
+						result.CompressedSize += int64(len(compressed))
+					}
+				}
+			}
+
+			if size > 0 {
+				result.Ratio = float64(result.CompressedSize) / float64(size)
+			}
+			result.CompressMBps = megabytesPerSecond(size*int64(rounds), compressTotal)
+			result.DecompressMBps = megabytesPerSecond(size*int64(rounds), decompressTotal)
+			result.CompressP50, result.CompressP99 = percentile(compressTimes, 50), percentile(compressTimes, 99)
+			result.DecompressP50, result.DecompressP99 = percentile(decompressTimes, 50), percentile(decompressTimes, 99)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func megabytesPerSecond(size int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(size) / 1e6 / elapsed.Seconds()
+}
+
+// percentile returns the nearest rank percentile of times, sorting them in place.
+func percentile(times []time.Duration, p int) time.Duration {
+	if len(times) == 0 {
+		return 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	rank := (p*len(times) + 99) / 100
+	return times[max(rank, 1)-1]
+}
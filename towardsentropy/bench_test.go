@@ -0,0 +1,67 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMeasureDictionaries(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	paths, _ := filepath.Glob("../testdata/files/supply_chain/*_chunk_1?.csv")
+	corpus := make([][]byte, 0, len(paths))
+	for _, path := range paths {
+		data, _ := os.ReadFile(path)
+		corpus = append(corpus, data)
+	}
+
+	results, err := MeasureDictionaries(corpus, MeasureOptions{
+		DictionaryIds: []string{"", "supply_chain"},
+		Levels:        []int{1, 9},
+		Rounds:        2,
+	})
+	if err != nil {
+		t.Fatalf("Could not measure: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	if results[0].DictionaryId != "" || results[1].Level != 9 || results[2].DictionaryId != "supply_chain" {
+		t.Errorf("Unexpected result order: %+v", results)
+	}
+	for _, result := range results {
+		if result.Files != len(corpus) || result.CompressedSize <= 0 || result.CompressedSize >= result.Size {
+			t.Errorf("Unexpected sizes: %+v", result)
+		}
+		if result.CompressP50 > result.CompressP99 || result.DecompressP50 > result.DecompressP99 || result.CompressMBps <= 0 {
+			t.Errorf("Unexpected timings: %+v", result)
+		}
+	}
+	if results[2].Ratio >= results[0].Ratio {
+		t.Errorf("Expected supply_chain to beat plain zstd on its own corpus: %f >= %f", results[2].Ratio, results[0].Ratio)
+	}
+
+	if _, err := MeasureDictionaries(corpus, MeasureOptions{DictionaryIds: []string{"missing"}}); err == nil {
+		t.Errorf("Expected an error for a missing dictionary")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	times := make([]time.Duration, 0, 100)
+	for i := 100; i > 0; i-- {
+		times = append(times, time.Duration(i))
+	}
+	if p50, p99 := percentile(times, 50), percentile(times, 99); p50 != 50 || p99 != 99 {
+		t.Errorf("Expected 50 and 99, got %d and %d", p50, p99)
+	}
+	if p := percentile([]time.Duration{7}, 99); p != 7 {
+		t.Errorf("Expected the only value, got %d", p)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DataDog/zstd"
+)
+
+// BulkCodec compresses and decompresses batches of small records against one
+// dictionary and level, spreading each batch over a fixed number of workers.
+// It is safe for concurrent use.
+type BulkCodec struct {
+	dictionaryId string
+	level        int
+	workers      int
+	compressor   *compressor   // nil for plain zstd
+	decompressor *decompressor // nil for plain zstd
+}
+
+// BulkResult is the outcome for one record of a batch.
+type BulkResult struct {
+	Data []byte
+	Err  error
+}
+
+// NewBulkCodec returns a BulkCodec for the dictionary dictionaryId, or plain
+// zstd when dictionaryId is "". A workers value below 1 uses GOMAXPROCS.
+func NewBulkCodec(dictionaryId string, level int, workers int) (*BulkCodec, error) {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	codec := &BulkCodec{dictionaryId: dictionaryId, level: level, workers: workers}
+	if dictionaryId == "" {
+		return codec, nil
+	}
+	compressor, err := getCompressor(dictionaryId, level)
+	if err != nil {
+		return nil, err
+	}
+	if compressor == nil {
+		return nil, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	decompressor, err := getDecompressor(dictionaryId)
+	if err != nil {
+		return nil, err
+	}
+	codec.compressor = compressor
+	codec.decompressor = decompressor
+	return codec, nil
+}
+
+// DictionaryId returns the dictionary the codec was built with.
+func (c *BulkCodec) DictionaryId() string {
+	return c.dictionaryId
+}
+
+// CompressBatch compresses every record, returning results in the same order.
+func (c *BulkCodec) CompressBatch(records [][]byte) []BulkResult {
+	return c.run(records, func(ctx zstd.Ctx, record []byte) ([]byte, error) {
+		if c.compressor == nil {
+			return ctx.CompressLevel(nil, record, c.level)
+		}
+		return c.compressor.compress(nil, record)
+	})
+}
+
+// DecompressBatch decompresses every record, returning results in the same order.
+func (c *BulkCodec) DecompressBatch(records [][]byte) []BulkResult {
+	return c.run(records, func(ctx zstd.Ctx, record []byte) ([]byte, error) {
+		if c.decompressor == nil {
+			return ctx.Decompress(nil, record)
+		}
+		return c.decompressor.decompress(nil, record)
+	})
+}
+
+func (c *BulkCodec) run(records [][]byte, fn func(zstd.Ctx, []byte) ([]byte, error)) []BulkResult {
+	results := make([]BulkResult, len(records))
+	workers := c.workers
+	if workers > len(records) {
+		workers = len(records)
+	}
+
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			// Each worker keeps its own context for plain zstd
+			var ctx zstd.Ctx
+			if c.compressor == nil {
+				ctx = zstd.NewCtx()
+			}
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(records) {
+					return
+				}
+				results[i].Data, results[i].Err = fn(ctx, records[i])
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,98 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func makeRecords(n int) [][]byte {
+	records := make([][]byte, n)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf(`{"event":"login","user":%d,"region":"us-east-1"}`, i))
+	}
+	return records
+}
+
+func TestBulkCodecRoundTrip(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	records := makeRecords(100)
+
+	for _, id := range []string{"", "supply_chain"} {
+		codec, err := NewBulkCodec(id, 3, 4)
+		if err != nil {
+			t.Fatalf("Could not create codec for '%s': %v", id, err)
+		}
+		compressed := codec.CompressBatch(records)
+		inputs := make([][]byte, len(compressed))
+		for i, result := range compressed {
+			if result.Err != nil {
+				t.Fatalf("Could not compress record %d: %v", i, result.Err)
+			}
+			inputs[i] = result.Data
+		}
+
+		for i, result := range codec.DecompressBatch(inputs) {
+			if result.Err != nil {
+				t.Fatalf("Could not decompress record %d: %v", i, result.Err)
+			}
+			if !bytes.Equal(result.Data, records[i]) {
+				t.Errorf("Record %d with '%s' does not match: %s", i, id, result.Data)
+			}
+		}
+	}
+}
+
+func TestBulkCodecPerRecordErrors(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	codec, err := NewBulkCodec("supply_chain", 3, 2)
+	if err != nil {
+		t.Fatalf("Could not create codec: %v", err)
+	}
+	good := codec.CompressBatch(makeRecords(1))[0].Data
+
+	results := codec.DecompressBatch([][]byte{good, []byte("not zstd"), good})
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Errorf("Expected valid records to decompress: %v, %v", results[0].Err, results[2].Err)
+	}
+	if results[1].Err == nil {
+		t.Errorf("Expected an error for the invalid record")
+	}
+}
+
+func TestNewBulkCodecMissingDictionary(t *testing.T) {
+	if _, err := NewBulkCodec("missing", 3, 1); err == nil {
+		t.Errorf("Expected error for missing dictionary")
+	}
+}
+
+func BenchmarkBulkCodecCompress(b *testing.B) {
+	updateCacheFromDir("../testdata/dictionaries")
+	codec, _ := NewBulkCodec("supply_chain", 3, 0)
+	records := makeRecords(1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		codec.CompressBatch(records)
+	}
+}
+
+func BenchmarkCompressPerRecord(b *testing.B) {
+	updateCacheFromDir("../testdata/dictionaries")
+	records := makeRecords(1000)
+	var dst bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, record := range records {
+			dst.Reset()
+			Compress(bytes.NewReader(record), &dst, "supply_chain")
+		}
+	}
+}
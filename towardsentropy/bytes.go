@@ -0,0 +1,308 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+// The ZSTD functions come from the C zstd bundled with github.com/DataDog/zstd.
+// Its BulkProcessor creates a context for every call; preparing the dictionary
+// here lets the contexts be pooled with it.
+
+/*
+#include <stddef.h>
+
+typedef struct ZSTD_CCtx_s ZSTD_CCtx;
+typedef struct ZSTD_DCtx_s ZSTD_DCtx;
+typedef struct ZSTD_CDict_s ZSTD_CDict;
+typedef struct ZSTD_DDict_s ZSTD_DDict;
+
+ZSTD_CCtx* ZSTD_createCCtx(void);
+size_t ZSTD_freeCCtx(ZSTD_CCtx* cctx);
+ZSTD_DCtx* ZSTD_createDCtx(void);
+size_t ZSTD_freeDCtx(ZSTD_DCtx* dctx);
+ZSTD_CDict* ZSTD_createCDict(const void* dictBuffer, size_t dictSize, int compressionLevel);
+size_t ZSTD_freeCDict(ZSTD_CDict* cdict);
+ZSTD_DDict* ZSTD_createDDict(const void* dictBuffer, size_t dictSize);
+size_t ZSTD_freeDDict(ZSTD_DDict* ddict);
+size_t ZSTD_compress_usingCDict(ZSTD_CCtx* cctx, void* dst, size_t dstCapacity,
+	const void* src, size_t srcSize, const ZSTD_CDict* cdict);
+size_t ZSTD_decompress_usingDDict(ZSTD_DCtx* dctx, void* dst, size_t dstCapacity,
+	const void* src, size_t srcSize, const ZSTD_DDict* ddict);
+unsigned long long ZSTD_getFrameContentSize(const void* src, size_t srcSize);
+unsigned ZSTD_isError(size_t code);
+const char* ZSTD_getErrorName(size_t code);
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/DataDog/zstd"
+)
+
+// dictionaryKey identifies the contents of a loaded dictionary. The hash keeps
+// a reloaded dictionary from reusing state built from its old contents.
+type dictionaryKey struct {
+	id   string
+	hash string
+}
+
+// compressorKey identifies a dictionary prepared for a compression level.
+type compressorKey struct {
+	dictionaryKey
+	level int
+}
+
+var (
+	processorsMu  sync.RWMutex
+	compressors   = make(map[compressorKey]*compressor)
+	decompressors = make(map[dictionaryKey]*decompressor)
+	plainCtxPool  = sync.Pool{New: func() interface{} { return zstd.NewCtx() }}
+)
+
+// compressor is a dictionary digested for one compression level, with a pool
+// of the contexts that compress with it. It is safe for concurrent use.
+type compressor struct {
+	cdict *C.ZSTD_CDict
+	ctxs  sync.Pool
+}
+
+// decompressor is a digested dictionary with a pool of the contexts that
+// decompress with it. It is safe for concurrent use.
+type decompressor struct {
+	ddict      *C.ZSTD_DDict
+	dictionary []byte // For frames that do not declare their size
+	ctxs       sync.Pool
+}
+
+// cctx and dctx free their C context once the pool drops them.
+type cctx struct{ c *C.ZSTD_CCtx }
+type dctx struct{ c *C.ZSTD_DCtx }
+
+func newCompressor(dictionary []byte, level int) (*compressor, error) {
+	cdict := C.ZSTD_createCDict(unsafe.Pointer(&dictionary[0]), C.size_t(len(dictionary)), C.int(level))
+	if cdict == nil {
+		return nil, zstd.ErrBadDictionary
+	}
+	c := &compressor{cdict: cdict}
+	c.ctxs.New = func() interface{} {
+		ctx := &cctx{c: C.ZSTD_createCCtx()}
+		runtime.SetFinalizer(ctx, func(ctx *cctx) { C.ZSTD_freeCCtx(ctx.c) })
+		return ctx
+	}
+	runtime.SetFinalizer(c, func(c *compressor) { C.ZSTD_freeCDict(c.cdict) })
+	return c, nil
+}
+
+func newDecompressor(dictionary []byte) (*decompressor, error) {
+	ddict := C.ZSTD_createDDict(unsafe.Pointer(&dictionary[0]), C.size_t(len(dictionary)))
+	if ddict == nil {
+		return nil, zstd.ErrBadDictionary
+	}
+	d := &decompressor{ddict: ddict, dictionary: dictionary}
+	d.ctxs.New = func() interface{} {
+		ctx := &dctx{c: C.ZSTD_createDCtx()}
+		runtime.SetFinalizer(ctx, func(ctx *dctx) { C.ZSTD_freeDCtx(ctx.c) })
+		return ctx
+	}
+	runtime.SetFinalizer(d, func(d *decompressor) { C.ZSTD_freeDDict(d.ddict) })
+	return d, nil
+}
+
+// compress compresses src, appending to dst[:0] when it has room.
+func (c *compressor) compress(dst, src []byte) ([]byte, error) {
+	bound := zstd.CompressBound(len(src))
+	if cap(dst) >= bound {
+		dst = dst[:bound]
+	} else {
+		dst = make([]byte, bound)
+	}
+	var srcPtr unsafe.Pointer
+	if len(src) > 0 {
+		srcPtr = unsafe.Pointer(&src[0])
+	}
+
+	ctx := c.ctxs.Get().(*cctx)
+	written := C.ZSTD_compress_usingCDict(ctx.c, unsafe.Pointer(&dst[0]), C.size_t(len(dst)), srcPtr, C.size_t(len(src)), c.cdict)
+	c.ctxs.Put(ctx)
+	runtime.KeepAlive(c)
+	if err := zstdError(written); err != nil {
+		return nil, err
+	}
+	return dst[:written], nil
+}
+
+// maxDeclaredSize bounds the buffer allocated for the size a frame declares,
+// larger frames are streamed into a growing buffer instead.
+const maxDeclaredSize = 1 << 20
+
+// decompress decompresses src, reusing dst when it has room.
+func (d *decompressor) decompress(dst, src []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, zstd.ErrEmptySlice
+	}
+	size := uint64(C.ZSTD_getFrameContentSize(unsafe.Pointer(&src[0]), C.size_t(len(src))))
+	// Unknown sizes and errors are the largest values
+	if size > maxDeclaredSize && size > 10*uint64(len(src)) {
+		return d.decompressStream(dst, src)
+	}
+	if cap(dst) > int(size) {
+		dst = dst[:size]
+	} else {
+		dst = make([]byte, size, size+1)
+	}
+
+	ctx := d.ctxs.Get().(*dctx)
+	written := C.ZSTD_decompress_usingDDict(ctx.c, unsafe.Pointer(&dst[:1][0]), C.size_t(size), unsafe.Pointer(&src[0]), C.size_t(len(src)), d.ddict)
+	d.ctxs.Put(ctx)
+	runtime.KeepAlive(d)
+	if zstdError(written) != nil {
+		// Further frames do not fit, or src is damaged and streaming says where
+		return d.decompressStream(dst, src)
+	}
+	return dst[:written], nil
+}
+
+func (d *decompressor) decompressStream(dst, src []byte) ([]byte, error) {
+	zr := newDecoder(bytes.NewReader(src), &Dictionary{Bytes: d.dictionary})
+	defer zr.Close()
+	buf := bytes.NewBuffer(dst[:0])
+	if _, err := io.Copy(buf, zr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func zstdError(code C.size_t) error {
+	if C.ZSTD_isError(code) == 0 {
+		return nil
+	}
+	return errors.New(C.GoString(C.ZSTD_getErrorName(code)))
+}
+
+// getCompressor returns dictionaryId prepared for compressing at level,
+// building it on first use. It returns nil for an unknown dictionary. The
+// cache holds one compressor per loaded dictionary and level used, and one
+// decompressor per loaded dictionary; those of dictionaries that were reloaded
+// or removed are dropped when a new one is built, and their C memory is freed
+// once no caller holds them.
+func getCompressor(dictionaryId string, level int) (*compressor, error) {
+	processorsMu.RLock()
+	// Read the cache directly, getDictionary copies the dictionary to the heap
+	dictionary, ok := dictionaries[dictionaryId]
+	key := compressorKey{dictionaryKey{dictionary.Id, dictionary.hash}, level}
+	c, cached := compressors[key]
+	processorsMu.RUnlock()
+	if !ok || cached {
+		return c, nil
+	}
+
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	if c, ok := compressors[key]; ok {
+		return c, nil
+	}
+	c, err := newCompressor(dictionary.Bytes, level)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare dictionary '%s': %v", dictionaryId, err)
+	}
+	dropStaleProcessors()
+	compressors[key] = c
+	return c, nil
+}
+
+// getDecompressor returns dictionaryId prepared for decompressing, building it
+// on first use. It returns nil for an unknown dictionary.
+func getDecompressor(dictionaryId string) (*decompressor, error) {
+	processorsMu.RLock()
+	dictionary, ok := dictionaries[dictionaryId]
+	key := dictionaryKey{dictionary.Id, dictionary.hash}
+	d, cached := decompressors[key]
+	processorsMu.RUnlock()
+	if !ok || cached {
+		return d, nil
+	}
+
+	processorsMu.Lock()
+	defer processorsMu.Unlock()
+	if d, ok := decompressors[key]; ok {
+		return d, nil
+	}
+	d, err := newDecompressor(dictionary.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare dictionary '%s': %v", dictionaryId, err)
+	}
+	dropStaleProcessors()
+	decompressors[key] = d
+	return d, nil
+}
+
+// dropStaleProcessors drops the prepared dictionaries whose dictionary was
+// reloaded or removed. The caller holds processorsMu.
+func dropStaleProcessors() {
+	stale := func(key dictionaryKey) bool {
+		current, ok := dictionaries[key.id]
+		return !ok || current.hash != key.hash
+	}
+	for key := range compressors {
+		if stale(key.dictionaryKey) {
+			delete(compressors, key)
+		}
+	}
+	for key := range decompressors {
+		if stale(key) {
+			delete(decompressors, key)
+		}
+	}
+}
+
+// CompressBytes compresses src with the dictionary dictionaryId, or plain zstd
+// when dictionaryId is "", appending to dst[:0] when it has room and allocating
+// otherwise. Dictionaries are prepared once per level and reused with pooled
+// contexts, which makes it much cheaper than CompressFile for small payloads.
+// It records no metrics.
+func CompressBytes(dst, src []byte, dictionaryId string) ([]byte, error) {
+	return compressBytes(dst, src, dictionaryId, getConfig().CompressionLevel)
+}
+
+func compressBytes(dst, src []byte, dictionaryId string, level int) ([]byte, error) {
+	if dictionaryId == "" {
+		ctx := plainCtxPool.Get().(zstd.Ctx)
+		defer plainCtxPool.Put(ctx)
+		return ctx.CompressLevel(dst, src, level)
+	}
+	c, err := getCompressor(dictionaryId, level)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	return c.compress(dst, src)
+}
+
+// DecompressBytes decompresses src with the dictionary dictionaryId, or plain
+// zstd when dictionaryId is "", reusing dst when it has room.
+func DecompressBytes(dst, src []byte, dictionaryId string) ([]byte, error) {
+	if dictionaryId == "" {
+		ctx := plainCtxPool.Get().(zstd.Ctx)
+		defer plainCtxPool.Put(ctx)
+		return ctx.Decompress(dst, src)
+	}
+	d, err := getDecompressor(dictionaryId)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return nil, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	return d.decompress(dst, src)
+}
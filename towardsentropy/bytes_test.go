@@ -0,0 +1,179 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCompressDecompressBytes(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	src := getBody()[:200]
+
+	for _, id := range []string{"", "supply_chain"} {
+		compressed, err := CompressBytes(nil, src, id)
+		if err != nil {
+			t.Fatalf("Could not compress with '%s': %v", id, err)
+		}
+		decompressed, err := DecompressBytes(nil, compressed, id)
+		if err != nil {
+			t.Fatalf("Could not decompress with '%s': %v", id, err)
+		}
+		if !bytes.Equal(src, decompressed) {
+			t.Errorf("Round trip with '%s' does not match", id)
+		}
+	}
+
+	if _, err := CompressBytes(nil, src, "missing"); err == nil {
+		t.Errorf("Expected error for missing dictionary")
+	}
+}
+
+func TestCompressBytesReusesDestination(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	src := getBody()[:200]
+	dst := make([]byte, 0, 4096)
+
+	compressed, err := CompressBytes(dst, src, "supply_chain")
+	if err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	if &compressed[0] != &dst[:1][0] {
+		t.Errorf("Expected dst to be reused")
+	}
+}
+
+func TestDecompressBytesStreamed(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+
+	// Streamed frames do not declare their content size
+	var compressed bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &compressed, "supply_chain"); err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	decompressed, err := DecompressBytes(nil, compressed.Bytes(), "supply_chain")
+	if err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if !bytes.Equal(body, decompressed) {
+		t.Errorf("Round trip does not match")
+	}
+}
+
+func BenchmarkCompressBytes(b *testing.B) {
+	updateCacheFromDir("../testdata/dictionaries")
+	src := getBody()[:200]
+	dst := make([]byte, 0, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := CompressBytes(dst, src, "supply_chain"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompressFile(b *testing.B) {
+	updateCacheFromDir("../testdata/dictionaries")
+	src := getBody()[:200]
+	var dst bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst.Reset()
+		if err := CompressFile(src, &dst, "supply_chain"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecompressBytes(b *testing.B) {
+	updateCacheFromDir("../testdata/dictionaries")
+	compressed, _ := CompressBytes(nil, getBody()[:200], "supply_chain")
+	dst := make([]byte, 0, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecompressBytes(dst, compressed, "supply_chain"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecompressFile(b *testing.B) {
+	updateCacheFromDir("../testdata/dictionaries")
+	compressed, _ := CompressBytes(nil, getBody()[:200], "supply_chain")
+	var dst bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dst.Reset()
+		if err := DecompressFile(compressed, &dst, "supply_chain"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPreparedDictionariesDropReloaded(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	addDictionary(Dictionary{Id: "reloaded", Bytes: body[:4096]})
+	defer delete(dictionaries, "reloaded")
+	old := dictionaries["reloaded"].hash
+	if _, err := getCompressor("reloaded", 3); err != nil {
+		t.Fatalf("Could not prepare dictionary: %v", err)
+	}
+	if _, err := getDecompressor("reloaded"); err != nil {
+		t.Fatalf("Could not prepare dictionary: %v", err)
+	}
+
+	addDictionary(Dictionary{Id: "reloaded", Bytes: body[4096:8192]})
+	if _, err := getCompressor("reloaded", 3); err != nil {
+		t.Fatalf("Could not prepare reloaded dictionary: %v", err)
+	}
+	processorsMu.RLock()
+	defer processorsMu.RUnlock()
+	for key := range compressors {
+		if key.hash == old {
+			t.Errorf("Expected the compressor for the old contents to be dropped: %+v", key)
+		}
+	}
+	for key := range decompressors {
+		if key.hash == old {
+			t.Errorf("Expected the decompressor for the old contents to be dropped: %+v", key)
+		}
+	}
+}
+
+func TestDecompressorSharedAcrossLevels(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	src := getBody()[:200]
+	for _, level := range []int{1, 3, 19} {
+		compressed, err := compressBytes(nil, src, "supply_chain", level)
+		if err != nil {
+			t.Fatalf("Could not compress at level %d: %v", level, err)
+		}
+		decompressed, err := DecompressBytes(nil, compressed, "supply_chain")
+		if err != nil || !bytes.Equal(decompressed, src) {
+			t.Errorf("Round trip at level %d does not match: %v", level, err)
+		}
+	}
+
+	processorsMu.RLock()
+	defer processorsMu.RUnlock()
+	count := 0
+	for key := range decompressors {
+		if key.id == "supply_chain" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected one decompressor for the dictionary, got %d", count)
+	}
+}
@@ -8,6 +8,7 @@ package towardsentropy
 
 import (
 	"encoding/json"
+	"log/slog"
 	"os"
 	"sync"
 )
@@ -20,6 +21,10 @@ type Config struct {
 	HandleHeadRequests  *bool              // Whether to forward HEAD requests to underlying handler
 	DictionaryMatchMap  *map[string]string // Map of request url match strings to dictionary ids
 	LogLevel            *LogLevel          // Log level
+	ExplainHeader       *bool              // Whether to explain dictionary selection in a response header
+	Logger              *slog.Logger       `json:"-"` // Destination for logs, slog.Default() when unset
+	CompressionWorkers  *int               // Threads zstd compresses a stream with, 1 for none
+	FrameSize           *int               // Start a new frame every FrameSize bytes and add a seek table, 0 for one frame
 }
 
 type internalConfig struct {
@@ -30,6 +35,10 @@ type internalConfig struct {
 	HandleHeadRequests  bool              // Whether to forward HEAD requests to underlying handler
 	DictionaryMatchMap  map[string]string // Map of request url match strings to dictionary ids
 	LogLevel            LogLevel          // Log level
+	ExplainHeader       bool              // Whether to explain dictionary selection in a response header
+	Logger              *slog.Logger      // Destination for logs, slog.Default() when unset
+	CompressionWorkers  int               // Threads zstd compresses a stream with, 1 for none
+	FrameSize           int               // Start a new frame every FrameSize bytes and add a seek table, 0 for one frame
 }
 
 type CompressionType string
@@ -61,6 +70,9 @@ var defaultConfig = Config{
 	PreflightWrites:     BoolPtr(true),
 	HandleHeadRequests:  BoolPtr(true),
 	DictionaryMatchMap:  MapPtr(make(map[string]string)),
+	ExplainHeader:       BoolPtr(false),
+	CompressionWorkers:  IntPtr(1),
+	FrameSize:           IntPtr(0),
 }
 
 func IntPtr(i int) *int                             { return &i }
@@ -108,6 +120,18 @@ func setConfig(cfg Config) {
 	if cfg.LogLevel != nil {
 		currentConfig.LogLevel = *cfg.LogLevel
 	}
+	if cfg.ExplainHeader != nil {
+		currentConfig.ExplainHeader = *cfg.ExplainHeader
+	}
+	if cfg.Logger != nil {
+		currentConfig.Logger = cfg.Logger
+	}
+	if cfg.CompressionWorkers != nil {
+		currentConfig.CompressionWorkers = *cfg.CompressionWorkers
+	}
+	if cfg.FrameSize != nil {
+		currentConfig.FrameSize = *cfg.FrameSize
+	}
 }
 
 // GetConfig returns the current configuration.
@@ -118,6 +142,11 @@ func getConfig() internalConfig {
 	return currentConfig
 }
 
+// InitWithJsonFile updates the configuration from a JSON file holding a Config.
+func InitWithJsonFile(path string) error {
+	return setConfigFromJsonFile(path)
+}
+
 // SetConfigFromJsonFile reads the JSON content from the specified file and updates the configuration.
 func setConfigFromJsonFile(path string) error {
 	// Read the content from the specified file path.
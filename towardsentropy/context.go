@@ -0,0 +1,66 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import "context"
+
+type contextKey int
+
+const (
+	dictionaryContextKey contextKey = iota
+	withoutCompressionContextKey
+	levelContextKey
+	negotiationContextKey
+	logAttrsContextKey
+	compressionTraceContextKey
+	compressedResponseContextKey
+)
+
+// WithDictionary returns a context that makes TowardsEntropyTransport use the
+// dictionary with the given id for requests made with it.
+func WithDictionary(ctx context.Context, dictionaryId string) context.Context {
+	return context.WithValue(ctx, dictionaryContextKey, dictionaryId)
+}
+
+// WithoutCompression returns a context that makes TowardsEntropyTransport send
+// requests made with it untouched.
+func WithoutCompression(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutCompressionContextKey, true)
+}
+
+// WithCompressedResponse returns a context that makes TowardsEntropyTransport
+// return responses to requests made with it still compressed, as
+// WithResponsePassthrough does for every request.
+func WithCompressedResponse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, compressedResponseContextKey, true)
+}
+
+// WithLevel returns a context that makes TowardsEntropyTransport compress request
+// bodies made with it at the given level instead of the configured one.
+func WithLevel(ctx context.Context, level int) context.Context {
+	return context.WithValue(ctx, levelContextKey, level)
+}
+
+func dictionaryFromContext(ctx context.Context) (string, bool) {
+	dictionaryId, ok := ctx.Value(dictionaryContextKey).(string)
+	return dictionaryId, ok
+}
+
+func compressionDisabledInContext(ctx context.Context) bool {
+	disabled, _ := ctx.Value(withoutCompressionContextKey).(bool)
+	return disabled
+}
+
+func compressedResponseInContext(ctx context.Context) bool {
+	compressed, _ := ctx.Value(compressedResponseContextKey).(bool)
+	return compressed
+}
+
+func levelFromContext(ctx context.Context) (int, bool) {
+	level, ok := ctx.Value(levelContextKey).(int)
+	return level, ok
+}
@@ -0,0 +1,147 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+type RecordingRoundTripper struct {
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (m *RecordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.requests = append(m.requests, req)
+	m.bodies = append(m.bodies, body)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewBufferString("OK")),
+	}, nil
+}
+
+func TestWithDictionaryRead(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	base := &RecordingRoundTripper{}
+	transport := NewTowardsEntropyTransport(base)
+
+	req, err := http.NewRequestWithContext(WithDictionary(context.Background(), "enwik8"), http.MethodGet, "http://example.com", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+
+	sent := base.requests[0]
+	if values := sent.Header.Values("Available-Dictionary"); len(values) != 1 || values[0] != "enwik8" {
+		t.Errorf("Unexpected Available-Dictionary: %v", values)
+	}
+	if sent.Header.Get("Dictionary-Id") != "enwik8" {
+		t.Errorf("Unexpected Dictionary-Id: %s", sent.Header.Get("Dictionary-Id"))
+	}
+}
+
+func TestWithDictionaryWrite(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		PreflightWrites:     BoolPtr(true),
+	})
+	base := &RecordingRoundTripper{}
+	transport := NewTowardsEntropyTransport(base)
+
+	body := getBody()
+	ctx := WithLevel(WithDictionary(context.Background(), "enwik8"), 1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+
+	// The forced dictionary skips the preflight
+	if len(base.requests) != 1 {
+		t.Fatalf("Expected a single request, got %d", len(base.requests))
+	}
+	sent := base.requests[0]
+	if sent.Header.Get("Dictionary-Id") != "enwik8" || sent.Header.Get("Content-Encoding") != string(SharedZstd) {
+		t.Errorf("Unexpected headers: %v", sent.Header)
+	}
+
+	InitWithStruct(Config{CompressionLevel: IntPtr(1)})
+	var expected bytes.Buffer
+	err = Compress(bytes.NewReader(body), &expected, "enwik8")
+	InitWithStruct(Config{CompressionLevel: IntPtr(5)})
+	if err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+	if !areSlicesEqual(base.bodies[0], expected.Bytes()) {
+		t.Errorf("Body was not compressed with the context level and dictionary")
+	}
+}
+
+func TestWithDictionaryMissing(t *testing.T) {
+	InitWithStruct(Config{PreflightWrites: BoolPtr(false)})
+	transport := NewTowardsEntropyTransport(&RecordingRoundTripper{})
+
+	ctx := WithDictionary(context.Background(), "missing")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com", bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Errorf("Expected error for missing dictionary")
+	}
+}
+
+func TestWithoutCompression(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		PreflightWrites:     BoolPtr(false),
+	})
+	base := &RecordingRoundTripper{}
+	transport := NewTowardsEntropyTransport(base)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		ctx := WithoutCompression(context.Background())
+		req, err := http.NewRequestWithContext(ctx, method, "http://example.com", bytes.NewReader([]byte("data")))
+		if err != nil {
+			t.Fatalf("Could not create HTTP request: %v", err)
+		}
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatalf("RoundTrip failed: %v", err)
+		}
+	}
+
+	for i, sent := range base.requests {
+		if sent.Header.Get("Accept-Encoding") != "" || sent.Header.Get("Content-Encoding") != "" {
+			t.Errorf("Unexpected headers on %s: %v", sent.Method, sent.Header)
+		}
+		if string(base.bodies[i]) != "data" {
+			t.Errorf("Unexpected body on %s: %s", sent.Method, base.bodies[i])
+		}
+	}
+}
@@ -7,21 +7,48 @@
 package towardsentropy
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 type Dictionary struct {
 	Id    string
 	Bytes []byte
+	hash  string
 }
 
+// Hash returns the hex encoded SHA-256 of the dictionary contents.
+func (d *Dictionary) Hash() string {
+	if d.hash == "" {
+		sum := sha256.Sum256(d.Bytes)
+		d.hash = hex.EncodeToString(sum[:])
+	}
+	return d.hash
+}
+
+// ZstdId returns the id zstd stores in the header of a trained dictionary, and
+// in frames compressed with it. Raw content dictionaries have none and return 0.
+func (d *Dictionary) ZstdId() uint32 {
+	if len(d.Bytes) < 8 || binary.LittleEndian.Uint32(d.Bytes) != zstdDictionaryMagic {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(d.Bytes[4:])
+}
+
+const zstdDictionaryMagic uint32 = 0xEC30A437
+
 var (
 	dictionaries = make(map[string]Dictionary)
 )
 
 func addDictionary(dict Dictionary) {
+	dict.Hash()
 	dictionaries[dict.Id] = dict
 }
 
@@ -37,6 +64,34 @@ func getDictionary(id string) *Dictionary {
 	return &dict
 }
 
+func dictionaryIds() []string {
+	ids := make([]string, 0, len(dictionaries))
+	for id := range dictionaries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// LoadDictionary adds the dictionary at path to the ones loaded from
+// DictionaryDirectory and returns its id, the file name without ".dict".
+func LoadDictionary(path string) (string, error) {
+	return loadDictionaryFile(path)
+}
+
+// dictionaryForZstdId returns the first loaded dictionary, by id, with the given zstd id.
+func dictionaryForZstdId(zstdId uint32) *Dictionary {
+	if zstdId == 0 {
+		return nil
+	}
+	for _, id := range dictionaryIds() {
+		if dict := getDictionary(id); dict.ZstdId() == zstdId {
+			return dict
+		}
+	}
+	return nil
+}
+
 func updateCacheFromDir(path string) error {
 	return filepath.Walk(path, maybeUpdateDictionary)
 }
@@ -51,15 +106,18 @@ func maybeUpdateDictionary(path string, info os.FileInfo, err error) error {
 	if filepath.Ext(path) != ".dict" {
 		return nil
 	}
+	_, err = loadDictionaryFile(path)
+	return err
+}
 
-	dictionaryId := filepath.Base(path)
-	dictionaryId = dictionaryId[:len(dictionaryId)-len(".dict")]
+func loadDictionaryFile(path string) (string, error) {
+	dictionaryId := strings.TrimSuffix(filepath.Base(path), ".dict")
 	bytes, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("error reading file")
+		return "", fmt.Errorf("error reading file %s: %v", path, err)
 	}
-	addDictionary(Dictionary{dictionaryId, bytes})
-	return nil
+	addDictionary(Dictionary{Id: dictionaryId, Bytes: bytes})
+	return dictionaryId, nil
 }
 
 func findDictionary(dictionaryIds []string) *Dictionary {
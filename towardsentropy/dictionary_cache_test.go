@@ -7,6 +7,8 @@
 package towardsentropy
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -18,3 +20,25 @@ func TestUpdateCacheFromDir(t *testing.T) {
 		t.Fatalf("Expected dictionary 'enwik8' to be loaded")
 	}
 }
+
+func TestLoadDictionary(t *testing.T) {
+	dictBytes, _ := os.ReadFile("../testdata/dictionaries/supply_chain.dict")
+	path := filepath.Join(t.TempDir(), "copied.dict")
+	os.WriteFile(path, dictBytes, 0644)
+
+	id, err := LoadDictionary(path)
+	if err != nil || id != "copied" {
+		t.Fatalf("Expected id 'copied', got %q: %v", id, err)
+	}
+	dict := getDictionary("copied")
+	if dict == nil || dict.ZstdId() == 0 {
+		t.Fatalf("Expected a loaded dictionary with a zstd id")
+	}
+	if (&Dictionary{Bytes: []byte("raw content")}).ZstdId() != 0 {
+		t.Errorf("Expected no zstd id for a raw content dictionary")
+	}
+	if _, err := LoadDictionary(filepath.Join(t.TempDir(), "missing.dict")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+	delete(dictionaries, "copied")
+}
@@ -0,0 +1,146 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Explanation describes how TowardsEntropyHandler picks a dictionary for a request.
+type Explanation struct {
+	URL                     string            // Request url used for rule matching
+	AcceptsSharedDictionary bool              // Whether the client accepts szstd
+	ForcedDictionaryId      string            // Dictionary the client forced with Dictionary-Id
+	MatchedRules            map[string]string // Match map rules whose pattern matches the url
+	OfferedDictionaries     []string          // Dictionaries the client sent in Available-Dictionary
+	ServerDictionaries      []string          // Dictionaries loaded on the server
+	Dictionary              *Dictionary       // Dictionary picked, nil when responding with plain zstd
+	Reason                  string            // Why the dictionary (or no dictionary) was picked
+	Rejected                map[string]string // Reasons offered dictionaries were not picked
+}
+
+// Explain reports how the handler would pick a dictionary for req without serving it.
+func (h *TowardsEntropyHandler) Explain(req *http.Request) *Explanation {
+	return h.selectDictionaryFromRequest(req)
+}
+
+// selectDictionaryFromRequest is the only dictionary selection path for the handler,
+// so what Explain reports is always what ServeHTTP does.
+func (h *TowardsEntropyHandler) selectDictionaryFromRequest(req *http.Request) *Explanation {
+	e := &Explanation{
+		URL:                 req.URL.String(),
+		MatchedRules:        make(map[string]string),
+		OfferedDictionaries: make([]string, 0),
+		ServerDictionaries:  dictionaryIds(),
+		Rejected:            make(map[string]string),
+	}
+	for pattern, id := range h.config.DictionaryMatchMap {
+		if matches(pattern, e.URL) {
+			e.MatchedRules[pattern] = id
+		}
+	}
+	e.OfferedDictionaries = append(e.OfferedDictionaries, headerTokens(req.Header, "Available-Dictionary")...)
+
+	e.AcceptsSharedDictionary = contains(headerTokens(req.Header, "Accept-Encoding"), string(SharedZstd))
+	if !e.AcceptsSharedDictionary {
+		h.logger.DebugContext(req.Context(), "Client does not accept shared dictionary", "url", e.URL)
+		e.Reason = "client does not accept " + string(SharedZstd)
+		e.rejectRemaining("client does not accept " + string(SharedZstd))
+		return e
+	}
+
+	// Shortcut if client forces dictionary
+	if forced := req.Header.Get("Dictionary-Id"); forced != "" {
+		h.logger.DebugContext(req.Context(), "Client forces dictionary", "dictionary_id", forced, "url", e.URL)
+		e.ForcedDictionaryId = forced
+		e.Dictionary = getDictionary(forced)
+		e.Reason = fmt.Sprintf("client forced dictionary '%s'", forced)
+		if e.Dictionary == nil {
+			e.Rejected[forced] = "not loaded on server"
+		}
+		e.rejectRemaining(fmt.Sprintf("client forced dictionary '%s'", forced))
+		return e
+	}
+
+	filteredDictionaryIds := h.getMatchingDictionaries(req, e.OfferedDictionaries)
+	for _, id := range e.OfferedDictionaries {
+		if id == "" {
+			e.Rejected[id] = "empty dictionary id"
+		} else if !contains(filteredDictionaryIds, id) {
+			e.Rejected[id] = fmt.Sprintf("rule '%s' does not match url", h.config.getInvertedMatchMap()[id])
+		} else if getDictionary(id) == nil {
+			e.Rejected[id] = "not loaded on server"
+		}
+	}
+
+	e.Dictionary = findDictionary(filteredDictionaryIds)
+	if e.Dictionary == nil {
+		if len(e.OfferedDictionaries) == 0 {
+			e.Reason = "client offered no dictionaries"
+		} else {
+			e.Reason = "no offered dictionary is usable"
+		}
+		return e
+	}
+	e.Reason = fmt.Sprintf("first usable dictionary offered by client is '%s'", e.Dictionary.Id)
+	e.rejectRemaining(fmt.Sprintf("client preferred '%s'", e.Dictionary.Id))
+	return e
+}
+
+// rejectRemaining records reason for every offered dictionary that was neither
+// picked nor already rejected.
+func (e *Explanation) rejectRemaining(reason string) {
+	for _, id := range e.OfferedDictionaries {
+		if _, ok := e.Rejected[id]; ok {
+			continue
+		}
+		if e.Dictionary != nil && e.Dictionary.Id == id {
+			continue
+		}
+		e.Rejected[id] = reason
+	}
+}
+
+// DictionaryId returns the id of the picked dictionary, or "" for plain zstd.
+func (e *Explanation) DictionaryId() string {
+	if e.Dictionary == nil {
+		return ""
+	}
+	return e.Dictionary.Id
+}
+
+// String formats the explanation on a single line so it fits in a header.
+func (e *Explanation) String() string {
+	rules := make([]string, 0, len(e.MatchedRules))
+	for pattern, id := range e.MatchedRules {
+		rules = append(rules, pattern+"->"+id)
+	}
+	sort.Strings(rules)
+
+	rejected := make([]string, 0, len(e.Rejected))
+	for id, reason := range e.Rejected {
+		rejected = append(rejected, id+": "+reason)
+	}
+	sort.Strings(rejected)
+
+	dictionaryId := e.DictionaryId()
+	if dictionaryId == "" {
+		dictionaryId = "none"
+	}
+	return fmt.Sprintf(
+		"selected=%s; reason=%s; offered=%s; matched=%s; server=%s; rejected=%s",
+		dictionaryId,
+		e.Reason,
+		strings.Join(e.OfferedDictionaries, ","),
+		strings.Join(rules, ","),
+		strings.Join(e.ServerDictionaries, ","),
+		strings.Join(rejected, ","),
+	)
+}
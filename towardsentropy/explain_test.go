@@ -0,0 +1,90 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"/data/*": "supply_chain", "/wiki/*": "enwik8"}),
+	})
+	updateCacheFromDir("../testdata/dictionaries")
+	handler := NewTowardsEntropyHandler(http.NotFoundHandler())
+
+	testCases := []struct {
+		name           string
+		path           string
+		acceptEncoding []string
+		available      []string
+		forced         string
+		expected       string
+		rejected       map[string]string
+	}{
+		{"no szstd", "/data/a.csv", []string{"zstd"}, []string{"supply_chain"}, "", "", map[string]string{"supply_chain": "client does not accept szstd"}},
+		{"match", "/data/a.csv", []string{"zstd", "szstd"}, []string{"enwik8", "supply_chain"}, "", "supply_chain", map[string]string{"enwik8": "rule '/wiki/*' does not match url"}},
+		{"not loaded", "/data/a.csv", []string{"zstd", "szstd"}, []string{"missing", "supply_chain"}, "", "supply_chain", map[string]string{"missing": "not loaded on server"}},
+		{"preference", "/data/a.csv", []string{"szstd"}, []string{"supply_chain", "other"}, "", "supply_chain", map[string]string{"other": "not loaded on server"}},
+		{"forced", "/data/a.csv", []string{"szstd"}, []string{"supply_chain"}, "enwik8", "enwik8", map[string]string{"supply_chain": "client forced dictionary 'enwik8'"}},
+		{"forced missing", "/data/a.csv", []string{"szstd"}, nil, "missing", "", map[string]string{"missing": "not loaded on server"}},
+		{"comma separated", "/data/a.csv", []string{"gzip, zstd, szstd;q=0.9"}, []string{"enwik8, supply_chain"}, "", "supply_chain", map[string]string{"enwik8": "rule '/wiki/*' does not match url"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tc.path, nil)
+			if err != nil {
+				t.Fatalf("Could not create HTTP request: %v", err)
+			}
+			for _, encoding := range tc.acceptEncoding {
+				req.Header.Add("Accept-Encoding", encoding)
+			}
+			for _, id := range tc.available {
+				req.Header.Add("Available-Dictionary", id)
+			}
+			if tc.forced != "" {
+				req.Header.Set("Dictionary-Id", tc.forced)
+			}
+
+			explanation := handler.Explain(req)
+			if explanation.DictionaryId() != tc.expected {
+				t.Fatalf("Expected dictionary '%s', got '%s' (%s)", tc.expected, explanation.DictionaryId(), explanation)
+			}
+			for id, reason := range tc.rejected {
+				if explanation.Rejected[id] != reason {
+					t.Errorf("Expected '%s' rejected with '%s', got '%s'", id, reason, explanation.Rejected[id])
+				}
+			}
+		})
+	}
+}
+
+func TestExplainHeader(t *testing.T) {
+	baseHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		ExplainHeader:       BoolPtr(true),
+	})
+	handler := NewTowardsEntropyHandler(baseHandler)
+	InitWithStruct(Config{ExplainHeader: BoolPtr(false)})
+
+	rr := executeRequest(handler, "GET", "/test", []string{"zstd", "szstd"}, []string{"supply_chain"}, t)
+
+	checkHeader(rr, "Dictionary-Id", "supply_chain", t)
+	if !strings.HasPrefix(rr.Header().Get("Dictionary-Explain"), "selected=supply_chain;") {
+		t.Errorf("Unexpected Dictionary-Explain header: %s", rr.Header().Get("Dictionary-Explain"))
+	}
+	checkBody("supply_chain", rr, "OK", t)
+}
@@ -0,0 +1,269 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// CompressedFileServer serves static files that may have precompressed
+// siblings: name.<dictionary id>.szst for a dictionary, name.zst for plain zstd.
+//
+// Wrapped in a TowardsEntropyHandler, a request for name whose negotiated
+// encoding matches a sibling gets the sibling untouched. Otherwise the original
+// is served and the handler compresses it on the fly. When only a sibling in
+// the seekable format exists it is decoded, reading just the frames a Range
+// request needs. Each representation gets its own ETag and Last-Modified.
+type CompressedFileServer struct {
+	root       fs.FS
+	fileServer http.Handler
+}
+
+// NewCompressedFileServer returns a CompressedFileServer for root. Seekable
+// siblings must implement io.ReaderAt, as files from os.DirFS and embed.FS do.
+//
+// The manifest Precompress keeps in the root, and temporary files it may leave
+// behind, are neither served nor listed.
+func NewCompressedFileServer(root fs.FS) *CompressedFileServer {
+	root = hidingFS{root}
+	return &CompressedFileServer{root: root, fileServer: http.FileServer(http.FS(root))}
+}
+
+func (s *CompressedFileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if name == "" || name == "." {
+		s.fileServer.ServeHTTP(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept-Encoding, Available-Dictionary")
+
+	negotiation, _ := NegotiationFromContext(r.Context())
+	// Ranges are served on the uncompressed representation
+	if negotiation != nil && r.Header.Get("Range") == "" && s.servePrecompressed(w, r, name, negotiation) {
+		return
+	}
+	if s.serveOriginal(w, r, name, negotiation) {
+		return
+	}
+	if s.serveSeekable(w, r, name, negotiation) {
+		return
+	}
+	s.fileServer.ServeHTTP(w, r)
+}
+
+// servePrecompressed sends the sibling matching the negotiated encoding as it
+// is. A sibling older than the original is stale and left for the original.
+func (s *CompressedFileServer) servePrecompressed(w http.ResponseWriter, r *http.Request, name string, negotiation *Negotiation) bool {
+	var sibling string
+	switch negotiation.ResponseEncoding {
+	case SharedZstd:
+		sibling = name + "." + negotiation.ResponseDictionaryId + ".szst"
+	case Zstd:
+		sibling = name + ".zst"
+	default:
+		return false
+	}
+	file, info, ok := s.open(sibling)
+	if !ok {
+		return false
+	}
+	defer file.Close()
+	if original, err := fs.Stat(s.root, name); err == nil && info.ModTime().Before(original.ModTime()) {
+		return false
+	}
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	header := w.Header()
+	header.Set("Content-Encoding", string(negotiation.ResponseEncoding))
+	if negotiation.ResponseEncoding == SharedZstd {
+		header.Set("Dictionary-Id", negotiation.ResponseDictionaryId)
+	}
+	header.Set("ETag", etag(info.Size(), info.ModTime(), "", false))
+	http.ServeContent(w, r, name, info.ModTime(), content)
+	return true
+}
+
+// serveOriginal sends the uncompressed file.
+func (s *CompressedFileServer) serveOriginal(w http.ResponseWriter, r *http.Request, name string, negotiation *Negotiation) bool {
+	file, info, ok := s.open(name)
+	if !ok {
+		return false
+	}
+	defer file.Close()
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	serveUncompressed(w, r, name, info, "", content, negotiation)
+	return true
+}
+
+// serveSeekable decodes a seekable sibling, trying loaded dictionaries in order
+// before plain zstd.
+func (s *CompressedFileServer) serveSeekable(w http.ResponseWriter, r *http.Request, name string, negotiation *Negotiation) bool {
+	candidates := make([][2]string, 0)
+	for _, id := range dictionaryIds() {
+		candidates = append(candidates, [2]string{name + "." + id + ".szst", id})
+	}
+	candidates = append(candidates, [2]string{name + ".zst", ""})
+
+	for _, candidate := range candidates {
+		file, info, ok := s.open(candidate[0])
+		if !ok {
+			continue
+		}
+		defer file.Close()
+		readerAt, ok := file.(io.ReaderAt)
+		if !ok {
+			continue
+		}
+		reader, err := NewSeekableReader(readerAt, info.Size(), candidate[1])
+		if err != nil {
+			continue
+		}
+		// Tagged apart from the sibling, which servePrecompressed sends as it is
+		serveUncompressed(w, r, name, info, "identity", reader, negotiation)
+		return true
+	}
+	return false
+}
+
+// serveUncompressed serves content from the file described by info, tagged for
+// the representation the client receives. The handler compresses full
+// responses when an encoding was negotiated, giving equivalent rather than byte
+// identical bodies, so they get a weak tag per encoding. Ranges go out as they
+// are and get a strong tag, which If-Range is checked against.
+func serveUncompressed(w http.ResponseWriter, r *http.Request, name string, info fs.FileInfo, identity string, content io.ReadSeeker, negotiation *Negotiation) {
+	tw := &taggingResponseWriter{ResponseWriter: w, identity: etag(info.Size(), info.ModTime(), identity, false)}
+	tw.compressed = tw.identity
+	if negotiation != nil && negotiation.ResponseEncoding != "" {
+		representation := string(negotiation.ResponseEncoding)
+		if negotiation.ResponseDictionaryId != "" {
+			representation += "-" + negotiation.ResponseDictionaryId
+		}
+		tw.compressed = etag(info.Size(), info.ModTime(), representation, true)
+	}
+	// The tag ServeContent checks conditions against, corrected once the status is known
+	if r.Header.Get("Range") != "" {
+		w.Header().Set("ETag", tw.identity)
+	} else {
+		w.Header().Set("ETag", tw.compressed)
+	}
+	http.ServeContent(tw, r, name, info.ModTime(), content)
+}
+
+// taggingResponseWriter sets the ETag of the representation a response turns
+// out to be: a range of the identity bytes or a full body the handler compresses.
+type taggingResponseWriter struct {
+	http.ResponseWriter
+	identity    string
+	compressed  string
+	wroteHeader bool
+}
+
+func (t *taggingResponseWriter) WriteHeader(code int) {
+	if !t.wroteHeader {
+		t.wroteHeader = true
+		if code == http.StatusPartialContent || t.Header().Get("Content-Range") != "" {
+			t.Header().Set("ETag", t.identity)
+		} else if code == http.StatusOK {
+			t.Header().Set("ETag", t.compressed)
+		}
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *taggingResponseWriter) Write(b []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(b)
+}
+
+// open opens name when it is a regular file.
+func (s *CompressedFileServer) open(name string) (fs.File, fs.FileInfo, bool) {
+	file, err := s.root.Open(name)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return nil, nil, false
+	}
+	return file, info, true
+}
+
+func etag(size int64, modTime time.Time, representation string, weak bool) string {
+	tag := fmt.Sprintf("%x-%x", size, modTime.UnixNano())
+	if representation != "" {
+		tag += "-" + representation
+	}
+	if weak {
+		return `W/"` + tag + `"`
+	}
+	return `"` + tag + `"`
+}
+
+// hidden reports whether name is a file Precompress writes for itself.
+func hidden(name string) bool {
+	base := path.Base(name)
+	return base == DefaultManifestName || base == DefaultManifestName+".tmp" ||
+		strings.HasSuffix(base, ".zst.tmp") || strings.HasSuffix(base, ".szst.tmp")
+}
+
+// hidingFS leaves out the files hidden reports, from Open and from directory listings.
+type hidingFS struct {
+	fs.FS
+}
+
+func (h hidingFS) Open(name string) (fs.File, error) {
+	if hidden(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	file, err := h.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// Only directories are wrapped, files keep io.Seeker and io.ReaderAt
+	if dir, ok := file.(fs.ReadDirFile); ok {
+		if info, err := file.Stat(); err == nil && info.IsDir() {
+			return hidingDir{dir}, nil
+		}
+	}
+	return file, nil
+}
+
+type hidingDir struct {
+	fs.ReadDirFile
+}
+
+func (d hidingDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	for {
+		entries, err := d.ReadDirFile.ReadDir(n)
+		visible := entries[:0]
+		for _, entry := range entries {
+			if !hidden(entry.Name()) {
+				visible = append(visible, entry)
+			}
+		}
+		// A batch of only hidden files must not look like the end of the directory
+		if len(visible) > 0 || len(entries) == 0 || err != nil || n <= 0 {
+			return visible, err
+		}
+	}
+}
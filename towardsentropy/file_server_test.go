@@ -0,0 +1,206 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func seekableFileHandler(t *testing.T) (http.Handler, []byte) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	body := getBody()
+	dir := t.TempDir()
+	compressed := compressFramed(t, body, "supply_chain", 1000)
+	if err := os.WriteFile(filepath.Join(dir, "data.csv.supply_chain.szst"), compressed, 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "plain.txt"), []byte("plain"), 0644); err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+	return NewTowardsEntropyHandler(NewCompressedFileServer(os.DirFS(dir))), body
+}
+
+func TestCompressedFileServerRange(t *testing.T) {
+	handler, body := seekableFileHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/data.csv", nil)
+	req.Header.Set("Accept-Encoding", "szstd")
+	req.Header.Set("Available-Dictionary", "supply_chain")
+	req.Header.Set("Range", "bytes=2900-3199")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	checkStatus(rr, http.StatusPartialContent, t)
+	if encoding := rr.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("Expected an uncompressed range, got Content-Encoding %s", encoding)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), body[2900:3200]) {
+		t.Errorf("Unexpected range contents")
+	}
+	expectedRange := fmt.Sprintf("bytes 2900-3199/%d", len(body))
+	if got := rr.Header().Get("Content-Range"); got != expectedRange {
+		t.Errorf("Expected Content-Range %s, got %s", expectedRange, got)
+	}
+}
+
+func TestCompressedFileServerFullResponse(t *testing.T) {
+	handler, body := seekableFileHandler(t)
+
+	rr := executeRequest(handler, "GET", "/data.csv", []string{"zstd", "szstd"}, []string{"supply_chain"}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", "szstd", t)
+	checkBody("supply_chain", rr, string(body), t)
+
+	rr = executeRequest(handler, "GET", "/plain.txt", []string{"zstd"}, []string{}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkBody("", rr, "plain", t)
+}
+
+func TestCompressedFileServerPrecompressed(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	body := getBody()
+	dir := t.TempDir()
+	var precompressed bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &precompressed, "supply_chain"); err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "data.csv"), body, 0644)
+	os.WriteFile(filepath.Join(dir, "data.csv.supply_chain.szst"), precompressed.Bytes(), 0644)
+	handler := NewTowardsEntropyHandler(NewCompressedFileServer(os.DirFS(dir)))
+
+	rr := executeRequest(handler, "GET", "/data.csv", []string{"zstd", "szstd"}, []string{"supply_chain"}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", "szstd", t)
+	checkHeader(rr, "Dictionary-Id", "supply_chain", t)
+	if !bytes.Equal(rr.Body.Bytes(), precompressed.Bytes()) {
+		t.Errorf("Expected the precompressed file untouched")
+	}
+	precompressedTag := rr.Header().Get("ETag")
+
+	// No zstd sibling, so plain zstd is compressed on the fly from the original
+	rr = executeRequest(handler, "GET", "/data.csv", []string{"zstd"}, []string{}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", "zstd", t)
+	checkHeader(rr, "Content-Length", "", t)
+	checkBody("", rr, string(body), t)
+	onTheFlyTag := rr.Header().Get("ETag")
+	if !strings.HasPrefix(onTheFlyTag, `W/"`) || onTheFlyTag == precompressedTag {
+		t.Errorf("Expected a distinct weak ETag on the fly, got %s and %s", onTheFlyTag, precompressedTag)
+	}
+
+	// Revalidating the precompressed representation
+	req := httptest.NewRequest(http.MethodGet, "/data.csv", nil)
+	req.Header.Set("Accept-Encoding", "szstd")
+	req.Header.Set("Available-Dictionary", "supply_chain")
+	req.Header.Set("If-None-Match", precompressedTag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	checkStatus(rr, http.StatusNotModified, t)
+	if rr.Body.Len() != 0 {
+		t.Errorf("Expected an empty body with 304, got %d bytes", rr.Body.Len())
+	}
+
+	// A range of the original gets a strong tag of its own
+	req = httptest.NewRequest(http.MethodGet, "/data.csv", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	req.Header.Set("Range", "bytes=0-9")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	checkStatus(rr, http.StatusPartialContent, t)
+	if rangeTag := rr.Header().Get("ETag"); strings.HasPrefix(rangeTag, `W/"`) || rangeTag == precompressedTag || rangeTag == onTheFlyTag {
+		t.Errorf("Expected a distinct strong ETag for the range, got %s", rangeTag)
+	}
+
+	// Only a seekable szstd sibling, decoded and compressed with zstd on the fly
+	seekableDir := t.TempDir()
+	os.WriteFile(filepath.Join(seekableDir, "data.csv.supply_chain.szst"), compressFramed(t, body, "supply_chain", 1000), 0644)
+	handler = NewTowardsEntropyHandler(NewCompressedFileServer(os.DirFS(seekableDir)))
+	rr = executeRequest(handler, "GET", "/data.csv", []string{"zstd"}, []string{}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", "zstd", t)
+	checkBody("", rr, string(body), t)
+	seekableTag := rr.Header().Get("ETag")
+	if !strings.HasPrefix(seekableTag, `W/"`) || !strings.HasSuffix(seekableTag, `-zstd"`) {
+		t.Errorf("Expected a weak zstd ETag for the decoded sibling, got %s", seekableTag)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/data.csv", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	req.Header.Set("Range", "bytes=0-9")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	checkStatus(rr, http.StatusPartialContent, t)
+	if rangeTag := rr.Header().Get("ETag"); strings.HasPrefix(rangeTag, `W/"`) || rangeTag == seekableTag {
+		t.Errorf("Expected a strong ETag for the range, got %s", rangeTag)
+	}
+}
+
+func TestCompressedFileServerStaleSibling(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	dir := t.TempDir()
+	var stale bytes.Buffer
+	Compress(bytes.NewReader([]byte("old contents")), &stale, "supply_chain")
+	os.WriteFile(filepath.Join(dir, "data.csv.supply_chain.szst"), stale.Bytes(), 0644)
+	os.WriteFile(filepath.Join(dir, "data.csv"), getBody(), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "data.csv.supply_chain.szst"), old, old)
+	handler := NewTowardsEntropyHandler(NewCompressedFileServer(os.DirFS(dir)))
+
+	// The original changed after the sibling was written, so it is compressed on the fly
+	rr := executeRequest(handler, "GET", "/data.csv", []string{"szstd"}, []string{"supply_chain"}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", "szstd", t)
+	checkBody("supply_chain", rr, string(getBody()), t)
+	if tag := rr.Header().Get("ETag"); !strings.HasPrefix(tag, `W/"`) {
+		t.Errorf("Expected the weak ETag of the on the fly representation, got %s", tag)
+	}
+}
+
+func TestCompressedFileServerHidesManifest(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "data.csv"), getBody(), 0644)
+	if _, err := Precompress(dir, PrecompressOptions{}); err != nil {
+		t.Fatalf("Could not precompress: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "data.csv.zst.tmp"), []byte("partial"), 0644)
+	handler := NewCompressedFileServer(os.DirFS(dir))
+
+	for _, name := range []string{"/" + DefaultManifestName, "/data.csv.zst.tmp"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, name, nil))
+		checkStatus(rr, http.StatusNotFound, t)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	checkStatus(rr, http.StatusOK, t)
+	listing := rr.Body.String()
+	if !strings.Contains(listing, "data.csv") || strings.Contains(listing, DefaultManifestName) || strings.Contains(listing, ".tmp") {
+		t.Errorf("Unexpected listing %s", listing)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// ForwardProxy is an HTTP proxy that sends requests through a
+// TowardsEntropyTransport, so clients that cannot use the transport get
+// dictionary compression by setting it as their proxy. Clients receive
+// responses uncompressed. HTTPS requests arrive as CONNECT tunnels and are
+// relayed without compression.
+type ForwardProxy struct {
+	proxy       *httputil.ReverseProxy
+	logger      Logger
+	dialTimeout time.Duration
+}
+
+// NewForwardProxy returns a ForwardProxy sending requests through a
+// TowardsEntropyTransport wrapping base, http.DefaultTransport when nil. When
+// base reads proxy settings from the environment, make sure they do not point
+// back at this proxy.
+func NewForwardProxy(base http.RoundTripper) *ForwardProxy {
+	config := getConfig()
+	transport := NewTowardsEntropyTransport(base)
+	return &ForwardProxy{
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.Out.Host = r.In.Host
+				// The transport negotiates the encoding itself
+				r.Out.Header.Del("Accept-Encoding")
+			},
+			Transport:      transport,
+			ModifyResponse: stripDecodedHeaders,
+		},
+		logger:      newLogger(config),
+		dialTimeout: 30 * time.Second,
+	}
+}
+
+// stripDecodedHeaders removes the headers describing the encoding from a
+// response the transport decompressed, as http.Transport does for gzip, so the
+// client does not try to decode the body again.
+func stripDecodedHeaders(resp *http.Response) error {
+	if resp.Uncompressed {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Dictionary-Id")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	}
+	return nil
+}
+
+func (p *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "only proxy requests with an absolute URL are served", http.StatusBadRequest)
+		return
+	}
+	p.proxy.ServeHTTP(w, r)
+}
+
+// tunnel relays a CONNECT request's bytes in both directions.
+func (p *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, p.dialTimeout)
+	if err != nil {
+		p.logger.WarnContext(r.Context(), "Could not connect tunnel", "host", r.Host, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upstream.Close()
+		p.logger.ErrorContext(r.Context(), "Could not take over connection for tunnel", "host", r.Host, "error", err)
+		http.Error(w, "tunnels are not supported", http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	relay := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		// Unblock the other direction
+		client.Close()
+		upstream.Close()
+		done <- struct{}{}
+	}
+	go relay(upstream, buffered)
+	go relay(client, upstream)
+	<-done
+	<-done
+}
@@ -0,0 +1,102 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestForwardProxy(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		PreflightWrites:     BoolPtr(false),
+	})
+	body := getBody()
+	var completions []Completion
+	var received []byte
+	origin := httptest.NewServer(NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			received, _ = io.ReadAll(r.Body)
+		}
+		w.Write(body)
+	}), WithCompletionFunc(func(r *http.Request, completion Completion) {
+		completions = append(completions, completion)
+	})))
+	defer origin.Close()
+	proxy := httptest.NewServer(NewForwardProxy(nil))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), DisableCompression: true}}
+
+	resp, err := client.Get(origin.URL + "/data.csv")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(got, body) {
+		t.Errorf("Expected the response uncompressed")
+	}
+	for _, name := range []string{"Content-Encoding", "Dictionary-Id"} {
+		if value := resp.Header.Get(name); value != "" {
+			t.Errorf("Expected no %s, got %s", name, value)
+		}
+	}
+
+	resp, err = client.Post(origin.URL+"/upload", "text/csv", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if !bytes.Equal(received, body) {
+		t.Errorf("Expected the origin to receive the body, got %d of %d bytes", len(received), len(body))
+	}
+
+	if len(completions) != 2 {
+		t.Fatalf("Expected 2 completions, got %d", len(completions))
+	}
+	if completions[0].ResponseEncoding != SharedZstd || completions[0].ResponseDictionaryId != "supply_chain" {
+		t.Errorf("Expected the response compressed with supply_chain on the link: %+v", completions[0])
+	}
+	if completions[1].RequestEncoding != SharedZstd || completions[1].RequestBytesIn >= completions[1].RequestBytesOut {
+		t.Errorf("Expected the request body compressed on the link: %+v", completions[1])
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(NewForwardProxy(nil))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	transport := origin.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	resp, err := (&http.Client{Transport: transport}).Get(origin.URL)
+	if err != nil {
+		t.Fatalf("Request through tunnel failed: %v", err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(got) != "secure" {
+		t.Errorf("Unexpected body through tunnel: %q", got)
+	}
+}
+
+func TestForwardProxyOriginForm(t *testing.T) {
+	rr := httptest.NewRecorder()
+	NewForwardProxy(nil).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/data.csv", nil))
+	checkStatus(rr, http.StatusBadRequest, t)
+}
@@ -0,0 +1,395 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+const (
+	zstdFrameMagic          uint32 = 0xFD2FB528
+	skippableFrameMagic     uint32 = 0x184D2A50
+	skippableFrameMagicMask uint32 = 0xFFFFFFF0
+)
+
+// FrameInfo describes one frame of a zstd stream.
+type FrameInfo struct {
+	Offset        int64  // Offset of the frame in the stream
+	Size          int64  // Compressed size of the frame, including its header
+	Skippable     bool   // Whether this is a skippable frame rather than a zstd frame
+	Magic         uint32 // Magic number the frame starts with
+	WindowSize    uint64 // Window size needed to decode the frame
+	ContentSize   int64  // Declared decompressed size, -1 when not declared
+	DictionaryId  uint32 // Zstd dictionary id the frame was compressed with, 0 when not declared
+	HasChecksum   bool   // Whether the frame ends with a content checksum
+	Blocks        int    // Number of blocks in the frame
+	SkippableSize uint32 // Size of the user data in a skippable frame
+	Dictionary    string // Id of the loaded dictionary with DictionaryId, set by InspectFrames
+}
+
+// InspectFrames parses the frame headers in r, naming the loaded dictionary
+// each frame needs. Block contents are skipped rather than decoded, so it works
+// without the dictionaries and on streams too damaged to decompress. When the
+// stream stops making sense it returns the frames before that point and an
+// error saying where.
+func InspectFrames(r io.Reader) ([]FrameInfo, error) {
+	var frames []FrameInfo
+	scanner := newFrameScanner(func(frame FrameInfo) {
+		if dict := dictionaryForZstdId(frame.DictionaryId); dict != nil {
+			frame.Dictionary = dict.Id
+		}
+		frames = append(frames, frame)
+	})
+	if _, err := io.Copy(scanner, r); err != nil {
+		return frames, err
+	}
+	return frames, scanner.finish()
+}
+
+type scanState int
+
+const (
+	scanMagic scanState = iota
+	scanSkippableSize
+	scanFrameHeaderDescriptor
+	scanFrameHeader
+	scanBlockHeader
+	scanSkip
+	scanFrameEnd
+)
+
+// frameScanner follows frame boundaries in a compressed stream written to it,
+// parsing headers and skipping over block contents. Each complete frame is
+// passed to onFrame rather than kept, so scanning a long stream takes constant
+// memory.
+type frameScanner struct {
+	state    scanState
+	buf      []byte
+	need     int
+	skip     int64
+	next     scanState
+	nextNeed int
+	offset   int64
+	frame    FrameInfo
+	onFrame  func(FrameInfo)
+	err      error
+}
+
+func newFrameScanner(onFrame func(FrameInfo)) *frameScanner {
+	return &frameScanner{state: scanMagic, need: 4, onFrame: onFrame}
+}
+
+// Write never fails so the scanner can sit beside a real writer; once the stream
+// stops making sense the rest is ignored and finish reports the error.
+func (s *frameScanner) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return len(p), nil
+	}
+	total := len(p)
+	for len(p) > 0 {
+		if s.state == scanSkip {
+			n := int64(len(p))
+			if n > s.skip {
+				n = s.skip
+			}
+			s.skip -= n
+			s.offset += n
+			p = p[n:]
+			if s.skip == 0 {
+				s.expect(s.next, s.nextNeed)
+			}
+		} else {
+			n := s.need - len(s.buf)
+			if n > len(p) {
+				n = len(p)
+			}
+			s.buf = append(s.buf, p[:n]...)
+			s.offset += int64(n)
+			p = p[n:]
+		}
+		if err := s.advance(); err != nil {
+			s.err = err
+			break
+		}
+	}
+	return total, nil
+}
+
+// expect moves to state once need bytes have been collected.
+func (s *frameScanner) expect(state scanState, need int) {
+	s.state = state
+	s.need = need
+	s.buf = s.buf[:0]
+}
+
+// skipThen skips n bytes and then moves to state, expecting need bytes.
+func (s *frameScanner) skipThen(n int64, state scanState, need int) {
+	if n == 0 {
+		s.expect(state, need)
+		return
+	}
+	s.state = scanSkip
+	s.skip = n
+	s.next = state
+	s.nextNeed = need
+	s.buf = s.buf[:0]
+}
+
+func (s *frameScanner) advance() error {
+	for s.state != scanSkip && len(s.buf) == s.need {
+		if err := s.step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *frameScanner) step() error {
+	switch s.state {
+	case scanMagic:
+		magic := binary.LittleEndian.Uint32(s.buf)
+		s.frame = FrameInfo{Offset: s.offset - 4, Magic: magic, ContentSize: -1}
+		if magic&skippableFrameMagicMask == skippableFrameMagic {
+			s.frame.Skippable = true
+			s.expect(scanSkippableSize, 4)
+		} else if magic == zstdFrameMagic {
+			s.expect(scanFrameHeaderDescriptor, 1)
+		} else {
+			return fmt.Errorf("unknown frame magic 0x%08X at offset %d", magic, s.frame.Offset)
+		}
+	case scanSkippableSize:
+		s.frame.SkippableSize = binary.LittleEndian.Uint32(s.buf)
+		s.skipThen(int64(s.frame.SkippableSize), scanFrameEnd, 0)
+	case scanFrameHeaderDescriptor:
+		descriptor := s.buf[0]
+		if descriptor&0x08 != 0 {
+			return fmt.Errorf("reserved bit set in frame header at offset %d", s.frame.Offset)
+		}
+		s.frame.HasChecksum = descriptor&0x04 != 0
+		// Keep the descriptor in buf so the whole header is parsed at once
+		s.state = scanFrameHeader
+		s.need = frameHeaderSize(descriptor)
+	case scanFrameHeader:
+		parseFrameHeader(s.buf, &s.frame)
+		s.expect(scanBlockHeader, 3)
+	case scanBlockHeader:
+		header := uint32(s.buf[0]) | uint32(s.buf[1])<<8 | uint32(s.buf[2])<<16
+		last := header&1 != 0
+		blockType := (header >> 1) & 3
+		blockSize := int64(header >> 3)
+		s.frame.Blocks++
+		if blockType == 3 {
+			return fmt.Errorf("reserved block type in frame at offset %d", s.frame.Offset)
+		}
+		if blockType == 1 {
+			blockSize = 1
+		}
+		if !last {
+			s.skipThen(blockSize, scanBlockHeader, 3)
+		} else if s.frame.HasChecksum {
+			s.skipThen(blockSize+4, scanFrameEnd, 0)
+		} else {
+			s.skipThen(blockSize, scanFrameEnd, 0)
+		}
+	case scanFrameEnd:
+		s.frame.Size = s.offset - s.frame.Offset
+		if s.onFrame != nil {
+			s.onFrame(s.frame)
+		}
+		s.expect(scanMagic, 4)
+	}
+	return nil
+}
+
+// finish reports an error when the stream ended part way through a frame.
+func (s *frameScanner) finish() error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.state != scanMagic || len(s.buf) != 0 {
+		return fmt.Errorf("stream ends part way through frame at offset %d", s.frame.Offset)
+	}
+	return nil
+}
+
+// frameHeaderSize returns the size of a frame header, excluding the magic number.
+func frameHeaderSize(descriptor byte) int {
+	singleSegment := descriptor&0x20 != 0
+	size := 1
+	if !singleSegment {
+		size++
+	}
+	size += []int{0, 1, 2, 4}[descriptor&0x03]
+	switch descriptor >> 6 {
+	case 0:
+		if singleSegment {
+			size++
+		}
+	case 1:
+		size += 2
+	case 2:
+		size += 4
+	case 3:
+		size += 8
+	}
+	return size
+}
+
+// parseFrameHeader fills frame from a header that starts with the descriptor byte.
+func parseFrameHeader(header []byte, frame *FrameInfo) {
+	descriptor := header[0]
+	singleSegment := descriptor&0x20 != 0
+	pos := 1
+	if !singleSegment {
+		exponent := uint64(header[pos] >> 3)
+		mantissa := uint64(header[pos] & 0x07)
+		windowBase := uint64(1) << (10 + exponent)
+		frame.WindowSize = windowBase + windowBase/8*mantissa
+		pos++
+	}
+
+	switch descriptor & 0x03 {
+	case 1:
+		frame.DictionaryId = uint32(header[pos])
+		pos++
+	case 2:
+		frame.DictionaryId = uint32(binary.LittleEndian.Uint16(header[pos:]))
+		pos += 2
+	case 3:
+		frame.DictionaryId = binary.LittleEndian.Uint32(header[pos:])
+		pos += 4
+	}
+
+	switch descriptor >> 6 {
+	case 0:
+		if singleSegment {
+			frame.ContentSize = int64(header[pos])
+		}
+	case 1:
+		frame.ContentSize = int64(binary.LittleEndian.Uint16(header[pos:])) + 256
+	case 2:
+		frame.ContentSize = int64(binary.LittleEndian.Uint32(header[pos:]))
+	case 3:
+		frame.ContentSize = int64(binary.LittleEndian.Uint64(header[pos:]))
+	}
+	if singleSegment {
+		frame.WindowSize = uint64(frame.ContentSize)
+	}
+}
+
+// DetectDictionary peeks at the header of the first frame in r and returns the
+// id of the loaded dictionary whose zstd id the frame declares. It returns ""
+// when the frame declares no dictionary or r does not start with a zstd frame,
+// and an error when the declared dictionary is not loaded. Nothing is consumed
+// from r.
+func DetectDictionary(r *bufio.Reader) (string, error) {
+	header, _ := r.Peek(4 + maxFrameHeaderSize)
+	if len(header) < 5 || binary.LittleEndian.Uint32(header) != zstdFrameMagic {
+		return "", nil
+	}
+	if len(header) < 4+frameHeaderSize(header[4]) {
+		return "", nil
+	}
+	frame := FrameInfo{ContentSize: -1}
+	parseFrameHeader(header[4:], &frame)
+	if frame.DictionaryId == 0 {
+		return "", nil
+	}
+	dict := dictionaryForZstdId(frame.DictionaryId)
+	if dict == nil {
+		return "", fmt.Errorf("frame needs zstd dictionary %d, which is not loaded", frame.DictionaryId)
+	}
+	return dict.Id, nil
+}
+
+// maxFrameHeaderSize is the largest frame header, excluding the magic number.
+const maxFrameHeaderSize = 14
+
+// newDecoder returns a zstd decoder for r. The input is cut at frame boundaries
+// because the decoder stops at the end of each frame and, if the rest of the
+// stream is already buffered when its source hits EOF, reports an unexpected
+// EOF instead of decoding the frames that follow.
+func newDecoder(r io.Reader, dictionary *Dictionary) io.ReadCloser {
+	return newBoundedDecoder(newFrameBoundedReader(r), dictionary)
+}
+
+func newBoundedDecoder(bounded *frameBoundedReader, dictionary *Dictionary) io.ReadCloser {
+	if dictionary == nil {
+		return zstd.NewReader(bounded)
+	}
+	return zstd.NewReaderDict(bounded, dictionary.Bytes)
+}
+
+func newPlainDecoder(r io.Reader) io.ReadCloser {
+	return newDecoder(r, nil)
+}
+
+// frameBoundedReader reads from r, never returning bytes from past the end of
+// a frame in the same Read as bytes from inside it.
+type frameBoundedReader struct {
+	r       io.Reader
+	scanner *frameScanner
+	buf     []byte
+	pending []byte  // Read from r but not yet returned
+	offset  int64   // Stream offset of pending[0]
+	ends    []int64 // Ends of the scanned frames not yet returned up to
+	frames  int     // Zstd frames scanned, ignoring skippable frames
+	err     error
+}
+
+func newFrameBoundedReader(r io.Reader) *frameBoundedReader {
+	f := &frameBoundedReader{r: r}
+	f.scanner = newFrameScanner(func(frame FrameInfo) {
+		f.ends = append(f.ends, frame.Offset+frame.Size)
+		if !frame.Skippable {
+			f.frames++
+		}
+	})
+	return f
+}
+
+func (f *frameBoundedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(f.pending) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		if cap(f.buf) < len(p) {
+			f.buf = make([]byte, len(p))
+		}
+		n, err := f.r.Read(f.buf[:len(p)])
+		f.err = err
+		f.scanner.Write(f.buf[:n])
+		f.pending = f.buf[:n]
+		if n == 0 {
+			return 0, err
+		}
+	}
+
+	n := len(f.pending)
+	if n > len(p) {
+		n = len(p)
+	}
+	// Frames the scanner has not finished yet end beyond everything read so far
+	if len(f.ends) > 0 && int64(n) > f.ends[0]-f.offset {
+		n = int(f.ends[0] - f.offset)
+	}
+	copy(p, f.pending[:n])
+	f.pending = f.pending[n:]
+	f.offset += int64(n)
+	for len(f.ends) > 0 && f.ends[0] <= f.offset {
+		f.ends = f.ends[1:]
+	}
+	return n, nil
+}
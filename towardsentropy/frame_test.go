@@ -0,0 +1,225 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrameScanner(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+
+	var stream bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &stream, "supply_chain"); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+	firstFrameSize := int64(stream.Len())
+
+	// A skippable frame between two zstd frames
+	skippable := make([]byte, 8+5)
+	binary.LittleEndian.PutUint32(skippable, skippableFrameMagic+3)
+	binary.LittleEndian.PutUint32(skippable[4:], 5)
+	stream.Write(skippable)
+	if err := Compress(bytes.NewReader([]byte("small")), &stream, ""); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+
+	// Feed the scanner a byte at a time to exercise every partial state
+	var frames []FrameInfo
+	scanner := newFrameScanner(func(frame FrameInfo) {
+		frames = append(frames, frame)
+	})
+	for _, b := range stream.Bytes() {
+		scanner.Write([]byte{b})
+	}
+	if err := scanner.finish(); err != nil {
+		t.Fatalf("Unexpected scanner error: %v", err)
+	}
+
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(frames))
+	}
+	first, skip, last := frames[0], frames[1], frames[2]
+	if first.Offset != 0 || first.Size != firstFrameSize || first.Blocks == 0 {
+		t.Errorf("Unexpected first frame: %+v", first)
+	}
+	if !skip.Skippable || skip.SkippableSize != 5 || skip.Offset != firstFrameSize || skip.Magic != skippableFrameMagic+3 {
+		t.Errorf("Unexpected skippable frame: %+v", skip)
+	}
+	if last.Offset != firstFrameSize+13 || last.Offset+last.Size != int64(stream.Len()) {
+		t.Errorf("Unexpected last frame: %+v", last)
+	}
+}
+
+func TestFrameScannerErrors(t *testing.T) {
+	var stream bytes.Buffer
+	if err := Compress(bytes.NewReader(getBody()), &stream, ""); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+
+	truncated := newFrameScanner(nil)
+	truncated.Write(stream.Bytes()[:stream.Len()-1])
+	if truncated.finish() == nil {
+		t.Errorf("Expected error for truncated stream")
+	}
+
+	garbage := newFrameScanner(nil)
+	garbage.Write([]byte("not a zstd stream"))
+	if garbage.finish() == nil {
+		t.Errorf("Expected error for unknown magic")
+	}
+}
+
+func TestParseFrameHeader(t *testing.T) {
+	testCases := []struct {
+		header   []byte
+		expected FrameInfo
+	}{
+		// Single segment with a one byte content size
+		{[]byte{0x20, 0x10}, FrameInfo{ContentSize: 16, WindowSize: 16}},
+		// Window descriptor, two byte dictionary id and a two byte content size
+		{[]byte{0x42, 0x08, 0x34, 0x12, 0x00, 0x01}, FrameInfo{ContentSize: 512, WindowSize: 2048, DictionaryId: 0x1234}},
+		// Window descriptor with mantissa, four byte dictionary id, no content size
+		{[]byte{0x03, 0x09, 0x78, 0x56, 0x34, 0x12}, FrameInfo{ContentSize: -1, WindowSize: 2048 + 256, DictionaryId: 0x12345678}},
+	}
+
+	for _, tc := range testCases {
+		if size := frameHeaderSize(tc.header[0]); size != len(tc.header) {
+			t.Errorf("Expected header size %d for descriptor 0x%02X, got %d", len(tc.header), tc.header[0], size)
+		}
+		frame := FrameInfo{ContentSize: -1}
+		parseFrameHeader(tc.header, &frame)
+		if frame != tc.expected {
+			t.Errorf("Unexpected frame for header %v: got %+v, expected %+v", tc.header, frame, tc.expected)
+		}
+	}
+}
+
+func TestDecompressConcatenatedFrames(t *testing.T) {
+	var stream bytes.Buffer
+	Compress(bytes.NewReader([]byte("first ")), &stream, "")
+	Compress(bytes.NewReader([]byte("second ")), &stream, "")
+	stream.Write([]byte{0x5A, 0x2A, 0x4D, 0x18, 1, 0, 0, 0, 0})
+	Compress(bytes.NewReader([]byte("third")), &stream, "")
+
+	for name, r := range map[string]io.Reader{
+		"whole":    bytes.NewReader(stream.Bytes()),
+		"one byte": iotest.OneByteReader(bytes.NewReader(stream.Bytes())),
+	} {
+		var out bytes.Buffer
+		if err := Decompress(r, &out, ""); err != nil {
+			t.Fatalf("Could not decompress %s: %v", name, err)
+		}
+		if out.String() != "first second third" {
+			t.Errorf("Unexpected output reading %s: %q", name, out.String())
+		}
+	}
+}
+
+func TestFrameBoundedReaderForgetsFrames(t *testing.T) {
+	var stream bytes.Buffer
+	for i := 0; i < 100; i++ {
+		Compress(bytes.NewReader([]byte("frame ")), &stream, "")
+	}
+	frameSize := int64(stream.Len() / 100)
+
+	decoder := newPlainDecoder(bytes.NewReader(stream.Bytes()))
+	bounded := newFrameBoundedReader(bytes.NewReader(stream.Bytes()))
+	buf := make([]byte, stream.Len())
+	for read := int64(0); read < int64(stream.Len()); {
+		n, err := bounded.Read(buf)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if int64(n) != frameSize {
+			t.Fatalf("Expected a read to stop at the frame end, got %d bytes", n)
+		}
+		read += int64(n)
+		if len(bounded.ends) > 100-int(read/frameSize) {
+			t.Fatalf("Expected passed frames to be dropped, %d kept", len(bounded.ends))
+		}
+	}
+	if len(bounded.ends) != 0 || bounded.frames != 100 {
+		t.Errorf("Expected 100 frames counted and none kept, got %d and %d", bounded.frames, len(bounded.ends))
+	}
+
+	out, err := io.ReadAll(decoder)
+	if err != nil || string(out) != strings.Repeat("frame ", 100) {
+		t.Errorf("Unexpected output %q: %v", out, err)
+	}
+}
+
+func TestDetectDictionary(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &compressed, "supply_chain")
+
+	r := bufio.NewReader(bytes.NewReader(compressed.Bytes()))
+	id, err := DetectDictionary(r)
+	if err != nil || id != "supply_chain" {
+		t.Fatalf("Expected supply_chain, got %q: %v", id, err)
+	}
+	var out bytes.Buffer
+	if err := Decompress(r, &out, id); err != nil || !bytes.Equal(out.Bytes(), getBody()) {
+		t.Errorf("Expected the peeked reader to decompress: %v", err)
+	}
+
+	var plain bytes.Buffer
+	Compress(bytes.NewReader([]byte("plain")), &plain, "")
+	for name, data := range map[string][]byte{"plain": plain.Bytes(), "empty": {}, "not zstd": []byte("hello world")} {
+		if id, err := DetectDictionary(bufio.NewReader(bytes.NewReader(data))); id != "" || err != nil {
+			t.Errorf("Expected no dictionary for %s, got %q: %v", name, id, err)
+		}
+	}
+
+	unknown := append([]byte(nil), compressed.Bytes()...)
+	dictionaryIdOffset := 5
+	if unknown[4]&0x20 == 0 {
+		dictionaryIdOffset++ // Window descriptor
+	}
+	binary.LittleEndian.PutUint32(unknown[dictionaryIdOffset:], 12345)
+	if _, err := DetectDictionary(bufio.NewReader(bytes.NewReader(unknown))); err == nil {
+		t.Errorf("Expected an error for a dictionary that is not loaded")
+	}
+}
+
+func TestInspectFrames(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	var stream bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &stream, "supply_chain")
+	stream.Write([]byte{0x5A, 0x2A, 0x4D, 0x18, 2, 0, 0, 0, 0, 0})
+	Compress(bytes.NewReader([]byte("plain")), &stream, "")
+
+	frames, err := InspectFrames(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatalf("Could not inspect: %v", err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(frames))
+	}
+	if frames[0].Dictionary != "supply_chain" || frames[0].DictionaryId == 0 || frames[0].Blocks == 0 {
+		t.Errorf("Unexpected dictionary frame: %+v", frames[0])
+	}
+	if !frames[1].Skippable || frames[1].SkippableSize != 2 || frames[1].Magic != 0x184D2A5A {
+		t.Errorf("Unexpected skippable frame: %+v", frames[1])
+	}
+	if frames[2].Dictionary != "" || frames[2].DictionaryId != 0 {
+		t.Errorf("Unexpected plain frame: %+v", frames[2])
+	}
+
+	frames, err = InspectFrames(bytes.NewReader(stream.Bytes()[:stream.Len()-3]))
+	if err == nil || len(frames) != 2 {
+		t.Errorf("Expected the first 2 frames and an error for a truncated stream, got %d: %v", len(frames), err)
+	}
+}
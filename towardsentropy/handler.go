@@ -7,121 +7,311 @@
 package towardsentropy
 
 import (
-	"log"
+	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/DataDog/zstd"
 )
 
+// responseLevel is the level responses are compressed at.
+const responseLevel = 5
+
 // zstdResponseWriter is an http.ResponseWriter that writes response with zstd.
 type TowardsEntropyHandler struct {
-	baseHandler http.Handler
-	config      internalConfig
-	logger      Logger
+	baseHandler  http.Handler
+	config       internalConfig
+	logger       Logger
+	onComplete   CompletionFunc
+	transcode    bool
+	gzipRequests bool
+	passthrough  bool
 }
 
-func NewTowardsEntropyHandler(baseHandler http.Handler) *TowardsEntropyHandler {
+func NewTowardsEntropyHandler(baseHandler http.Handler, opts ...HandlerOption) *TowardsEntropyHandler {
 	config := getConfig()
-	return &TowardsEntropyHandler{
+	h := &TowardsEntropyHandler{
 		baseHandler: baseHandler,
 		config:      config,
-		logger:      Logger{config.LogLevel},
+		logger:      newLogger(config),
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	return h
 }
 
 func (h *TowardsEntropyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	h.maybeDecompressRequest(r)
-	dictionary := h.selectDictionaryFromRequest(r)
-	h.handleWithDictionary(w, r, dictionary)
+	completion := &Completion{}
+	in, out, err := h.maybeDecompressRequest(r, completion)
+	// Deferred so the completion is reported when the wrapped handler panics
+	defer h.complete(r, completion, in, out)
+	if err != nil {
+		h.logger.WarnContext(r.Context(), "Rejected request body", "url", r.URL.String(), "error", err)
+		defaultMetrics.recordError(sourceHandler, "decompress")
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	} else {
+		h.negotiateAndHandle(w, r, completion)
+	}
+}
+
+func (h *TowardsEntropyHandler) complete(r *http.Request, completion *Completion, in, out *countingReadCloser) {
+	if in != nil {
+		completion.RequestBytesIn = in.count
+		completion.RequestBytesOut = out.count
+	}
+	h.logger.DebugContext(r.Context(), "Response complete",
+		"url", r.URL.String(),
+		"encoding", completion.ResponseEncoding,
+		"dictionary_id", completion.ResponseDictionaryId,
+		"bytes_in", completion.ResponseBytesIn,
+		"bytes_out", completion.ResponseBytesOut,
+	)
+	if h.onComplete != nil {
+		h.onComplete(r, *completion)
+	}
+}
+
+func (h *TowardsEntropyHandler) negotiateAndHandle(w http.ResponseWriter, r *http.Request, completion *Completion) {
+	explanation := h.selectDictionaryFromRequest(r)
+	if h.config.ExplainHeader {
+		w.Header().Set("Dictionary-Explain", explanation.String())
+	}
+
+	completion.ResponseEncoding = Zstd
+	if explanation.Dictionary != nil {
+		completion.ResponseEncoding = SharedZstd
+		completion.ResponseDictionaryId = explanation.Dictionary.Id
+	}
+	r = r.WithContext(withNegotiation(r.Context(), &completion.Negotiation))
+
+	h.recordNegotiation(explanation)
+	ContextCompressionTrace(r.Context()).dictionarySelected(DictionarySelectedInfo{
+		Encoding:     completion.ResponseEncoding,
+		DictionaryId: completion.ResponseDictionaryId,
+		Explanation:  explanation,
+	})
+
+	h.handleWithDictionary(w, r, explanation.Dictionary, completion)
 }
 
-func (h *TowardsEntropyHandler) maybeDecompressRequest(r *http.Request) {
+// maybeDecompressRequest returns counters for the request body before and after
+// decompression. It fails when the body needs a dictionary that is not loaded.
+func (h *TowardsEntropyHandler) maybeDecompressRequest(r *http.Request, completion *Completion) (*countingReadCloser, *countingReadCloser, error) {
 	if (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch) || r.Body == nil {
-		return
+		return nil, nil, nil
 	}
 
+	trace := ContextCompressionTrace(r.Context())
 	encoding := r.Header.Get("Content-Encoding")
-	if encoding == string(Zstd) {
-		r.Body = zstd.NewReader(r.Body)
+	var body *meteredReadCloser
+	if h.passthrough && (encoding == string(Zstd) || encoding == string(SharedZstd)) {
+		h.logger.DebugContext(r.Context(), "Forwarding compressed request body", "encoding", encoding, "url", r.URL.String())
+		completion.RequestEncoding = CompressionType(encoding)
+		completion.RequestDictionaryId = r.Header.Get("Dictionary-Id")
+		counting := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = counting
+		return counting, counting, nil
+	} else if encoding == string(Zstd) {
+		body = newMeteredReadCloser(newContextReadCloser(r.Context(), r.Body), sourceHandler, "", trace, newPlainDecoder)
+		completion.RequestEncoding = Zstd
 	} else if encoding == string(SharedZstd) {
 		dictionaryId := r.Header.Get("Dictionary-Id")
+		completion.RequestEncoding = SharedZstd
+		completion.RequestDictionaryId = dictionaryId
 		dictionary := getDictionary(dictionaryId)
 		if dictionary == nil {
-			// TODO error handle, this would be BAD!
-			log.Fatalf("No dictionary found for request")
+			return nil, nil, fmt.Errorf("request body needs dictionary '%s', which is not loaded", dictionaryId)
 		}
-		r.Body = zstd.NewReaderDict(r.Body, dictionary.Bytes)
+		body = newMeteredReadCloser(newContextReadCloser(r.Context(), r.Body), sourceHandler, dictionary.Id, trace, func(r io.Reader) io.ReadCloser {
+			return newDecoder(r, dictionary)
+		})
+	} else {
+		counting := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = counting
+		return counting, counting, nil
 	}
+
+	r.Body = body
+	return body.compressed, body.decompressed, nil
 }
 
-func (h *TowardsEntropyHandler) selectDictionaryFromRequest(req *http.Request) *Dictionary {
-	if !contains(req.Header.Values("Accept-Encoding"), string(SharedZstd)) {
-		h.logger.Debug("Client does not accept shared dictionary")
-		return nil
+// decodedRequest returns r as the wrapped handler should see it. Once the body
+// is decompressed its encoding headers no longer apply, and an upstream the
+// handler forwards to would otherwise try to decode it again. Negotiation reads
+// Dictionary-Id from r first, so the headers are removed from a copy.
+func (h *TowardsEntropyHandler) decodedRequest(r *http.Request, completion *Completion) *http.Request {
+	if completion.RequestEncoding == "" || h.passthrough {
+		return r
 	}
-
-	// Shortcut if client forces dictionary
-	if req.Header.Get("Dictionary-Id") != "" {
-		h.logger.Debugf("Client forces dictionary: %s", req.Header.Get("Dictionary-Id"))
-		dictionaryId := req.Header.Get("Dictionary-Id")
-		return getDictionary(dictionaryId)
+	r = r.Clone(r.Context())
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Dictionary-Id")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	if h.gzipRequests {
+		r.Body = newGzipBody(r.Body)
+		r.Header.Set("Content-Encoding", "gzip")
 	}
-
-	dictionaryIds := req.Header.Values("Available-Dictionary")
-	for i, id := range dictionaryIds {
-		dictionaryIds[i] = strings.TrimSpace(id)
-	}
-	filteredDictionaryIds := h.getMatchingDictionaries(req, dictionaryIds)
-	return findDictionary(filteredDictionaryIds)
+	return r
 }
 
-func (h *TowardsEntropyHandler) handleWithDictionary(w http.ResponseWriter, r *http.Request, dict *Dictionary) {
+func (h *TowardsEntropyHandler) handleWithDictionary(w http.ResponseWriter, r *http.Request, dict *Dictionary, completion *Completion) {
 	if r.Method == http.MethodHead && h.config.HandleHeadRequests {
 		h.handleHeadRequest(w, r, dict)
 		return
 	}
 
+	trace := ContextCompressionTrace(r.Context())
+	out := &countingWriter{Writer: w}
+	headers := make(http.Header)
 	var zw *zstd.Writer
 	if dict == nil {
-		h.logger.Debug("Compressing response with no dictionary")
-		zw = zstd.NewWriterLevel(w, 5)
-		w.Header().Set("Content-Encoding", string(Zstd))
+		h.logger.DebugContext(r.Context(), "Compressing response", "encoding", Zstd, "url", r.URL.String())
+		zw = zstd.NewWriterLevel(out, responseLevel)
+		headers.Set("Content-Encoding", string(Zstd))
 	} else {
-		h.logger.Debugf("Compressing response with dictionary %s", dict.Id)
-		zw = zstd.NewWriterLevelDict(w, 5, dict.Bytes)
-		w.Header().Set("Content-Encoding", string(SharedZstd))
-		w.Header().Set("Dictionary-Id", dict.Id)
+		h.logger.DebugContext(r.Context(), "Compressing response", "encoding", SharedZstd, "dictionary_id", dict.Id, "url", r.URL.String())
+		zw = zstd.NewWriterLevelDict(out, responseLevel, dict.Bytes)
+		headers.Set("Content-Encoding", string(SharedZstd))
+		headers.Set("Dictionary-Id", dict.Id)
 	}
-	defer zw.Close()
 
 	zstdResponseWriter := &zstdResponseWriter{
 		ResponseWriter: w,
 		Writer:         zw,
+		ctx:            r.Context(),
+		headers:        headers,
+		transcode:      h.transcode,
+		head:           r.Method == http.MethodHead,
+		trace:          trace,
+		compressStart: CompressStartInfo{
+			Encoding:     completion.ResponseEncoding,
+			DictionaryId: completion.ResponseDictionaryId,
+			Level:        responseLevel,
+		},
+	}
+	// The encoder holds C memory, so it is closed however the wrapped handler
+	// returns. A panic, such as http.ErrAbortHandler from a reverse proxy whose
+	// upstream failed mid body, leaves the response broken and drops the frame.
+	finished, failure := false, "abort"
+	defer func() {
+		if finished {
+			return
+		}
+		h.logger.DebugContext(r.Context(), "Response aborted", "url", r.URL.String())
+		defaultMetrics.recordError(sourceHandler, failure)
+		// Stop the transcoder first, it writes to the encoder on its own goroutine
+		zstdResponseWriter.abortTranscoding()
+		out.Writer = io.Discard
+		zw.Close()
+		completion.ResponseBytesIn = zstdResponseWriter.written
+		completion.ResponseBytesOut = out.count
+		if zstdResponseWriter.compressing {
+			trace.compressDone(CompressDoneInfo{
+				Encoding:     completion.ResponseEncoding,
+				DictionaryId: completion.ResponseDictionaryId,
+				BytesIn:      completion.ResponseBytesIn,
+				BytesOut:     completion.ResponseBytesOut,
+				Elapsed:      zstdResponseWriter.elapsed,
+				Err:          http.ErrAbortHandler,
+			})
+		}
+	}()
+
+	decoded := h.decodedRequest(r, completion)
+	if body, ok := decoded.Body.(*gzipBody); ok {
+		// Stop the compressing goroutine when the wrapped handler leaves the body unread
+		defer body.Close()
+	}
+	h.baseHandler.ServeHTTP(zstdResponseWriter, decoded)
+	if !zstdResponseWriter.wroteHeader {
+		zstdResponseWriter.WriteHeader(http.StatusOK)
+	}
+	if err := zstdResponseWriter.finishTranscoding(); err != nil {
+		// The status is already sent, abort the response so the client sees it is broken
+		h.logger.WarnContext(r.Context(), "Could not transcode response", "url", r.URL.String(), "error", err)
+		failure = "transcode"
+		panic(http.ErrAbortHandler)
+	}
+	finished = true
+	if zstdResponseWriter.passthrough {
+		// Drop the unused encoder without writing its frame
+		out.Writer = io.Discard
+		zw.Close()
+		if zstdResponseWriter.partial {
+			defaultMetrics.recordFallback(sourceHandler, "range_request")
+		}
+		h.logger.DebugContext(r.Context(), "Forwarded encoded response", "encoding", w.Header().Get("Content-Encoding"), "url", r.URL.String())
+		completion.ResponseEncoding = CompressionType(w.Header().Get("Content-Encoding"))
+		completion.ResponseDictionaryId = w.Header().Get("Dictionary-Id")
+		completion.ResponseBytesIn = zstdResponseWriter.written
+		completion.ResponseBytesOut = zstdResponseWriter.written
+		return
+	}
+	start := time.Now()
+	err := zw.Close()
+	if err != nil {
+		defaultMetrics.recordError(sourceHandler, "compress")
+	}
+	elapsed := zstdResponseWriter.elapsed + time.Since(start)
+
+	completion.ResponseBytesIn = zstdResponseWriter.written
+	completion.ResponseBytesOut = out.count
+	defaultMetrics.recordCompress(sourceHandler, completion.ResponseDictionaryId, completion.ResponseBytesIn, completion.ResponseBytesOut, elapsed)
+	trace.compressDone(CompressDoneInfo{
+		Encoding:     completion.ResponseEncoding,
+		DictionaryId: completion.ResponseDictionaryId,
+		BytesIn:      completion.ResponseBytesIn,
+		BytesOut:     completion.ResponseBytesOut,
+		Elapsed:      elapsed,
+		Err:          err,
+	})
+}
+
+func (h *TowardsEntropyHandler) recordNegotiation(explanation *Explanation) {
+	defaultMetrics.recordNegotiation(sourceHandler, explanation.DictionaryId())
+	if explanation.Dictionary != nil {
+		return
+	}
+
+	if !explanation.AcceptsSharedDictionary {
+		defaultMetrics.recordFallback(sourceHandler, "shared_dictionary_not_accepted")
+	} else if explanation.ForcedDictionaryId != "" {
+		defaultMetrics.recordFallback(sourceHandler, "forced_dictionary_not_loaded")
+	} else if len(explanation.OfferedDictionaries) == 0 {
+		defaultMetrics.recordFallback(sourceHandler, "no_dictionary_offered")
+	} else {
+		defaultMetrics.recordFallback(sourceHandler, "no_usable_dictionary")
 	}
-	h.baseHandler.ServeHTTP(zstdResponseWriter, r)
 }
 
 func (h *TowardsEntropyHandler) handleHeadRequest(w http.ResponseWriter, r *http.Request, dictionary *Dictionary) {
 	if dictionary != nil {
-		h.logger.Debugf("Handling HEAD request with dictionary %s", dictionary.Id)
+		h.logger.DebugContext(r.Context(), "Handling HEAD request", "encoding", SharedZstd, "dictionary_id", dictionary.Id, "url", r.URL.String())
 		w.Header().Set("Dictionary-Id", dictionary.Id)
 		w.Header().Set("Content-Encoding", string(SharedZstd))
 		w.WriteHeader(http.StatusOK)
 	} else {
-		h.logger.Debug("Handling HEAD request with no dictionary")
+		h.logger.DebugContext(r.Context(), "Handling HEAD request", "encoding", Zstd, "url", r.URL.String())
 		w.Header().Set("Content-Encoding", string(Zstd))
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func (h *TowardsEntropyHandler) getMatchingDictionaries(req *http.Request, dictionaryIds []string) []string {
+	return dictionariesMatching(h.config, req.URL.String(), dictionaryIds)
+}
+
+// dictionariesMatching returns the ids whose DictionaryMatchMap rule matches url.
+func dictionariesMatching(config internalConfig, url string, dictionaryIds []string) []string {
 	matchingIds := make([]string, 0)
-	invertedMatchMap := h.config.getInvertedMatchMap()
+	invertedMatchMap := config.getInvertedMatchMap()
 
 	for _, id := range dictionaryIds {
 		pattern := invertedMatchMap[id]
-		if matches(pattern, req.URL.String()) {
+		if matches(pattern, url) {
 			matchingIds = append(matchingIds, id)
 		}
 	}
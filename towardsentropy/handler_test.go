@@ -8,9 +8,15 @@ package towardsentropy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestServeHTTPBasic(t *testing.T) {
@@ -78,6 +84,33 @@ func TestServeHTTPDictionary(t *testing.T) {
 	checkBody("supply_chain", rr, "", t)
 }
 
+func TestServeHTTPClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var writeErr error
+	baseHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+		cancel()
+		_, writeErr = w.Write([]byte("more"))
+	})
+
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	handler := NewTowardsEntropyHandler(baseHandler)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "/test", nil)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.Header.Add("Accept-Encoding", "zstd")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !errors.Is(writeErr, context.Canceled) {
+		t.Errorf("Expected context.Canceled writing after client left, got %v", writeErr)
+	}
+}
+
 func executeRequest(
 	handler http.Handler,
 	method, path string,
@@ -125,3 +158,135 @@ func checkBody(dictionaryId string, rr *httptest.ResponseRecorder, expected stri
 		t.Errorf("Handler returned wrong body: got %v, expected %v", bodyString, expected)
 	}
 }
+
+func TestServeHTTPRangeUncompressed(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "test.txt", time.Time{}, strings.NewReader("0123456789"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Accept-Encoding", "szstd")
+	req.Header.Set("Available-Dictionary", "supply_chain")
+	req.Header.Set("Range", "bytes=2-4")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	checkStatus(rr, http.StatusPartialContent, t)
+	checkHeader(rr, "Content-Encoding", "", t)
+	if rr.Body.String() != "234" {
+		t.Errorf("Expected 234, got %q", rr.Body.String())
+	}
+}
+
+func TestServeHTTPRangeIgnored(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("full body"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	req.Header.Set("Range", "bytes=0-")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", string(Zstd), t)
+	checkBody("", rr, "full body", t)
+}
+
+func TestServeHTTPRequestDecoded(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	var seen http.Header
+	var seenLength int64
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, seenLength = r.Header, r.ContentLength
+		io.Copy(w, r.Body)
+	}))
+
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &compressed, "supply_chain")
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "supply_chain")
+	req.Header.Set("Content-Length", fmt.Sprint(compressed.Len()))
+	req.Header.Set("Accept-Encoding", string(SharedZstd))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	checkStatus(rr, http.StatusOK, t)
+	// The forced dictionary still applies to the response
+	checkHeader(rr, "Dictionary-Id", "supply_chain", t)
+	checkBody("supply_chain", rr, string(getBody()), t)
+	for _, name := range []string{"Content-Encoding", "Dictionary-Id", "Content-Length"} {
+		if seen.Get(name) != "" {
+			t.Errorf("Expected %s to be removed from the decoded request, got %s", name, seen.Get(name))
+		}
+	}
+	if seenLength != -1 {
+		t.Errorf("Expected an unknown length for the decoded request, got %d", seenLength)
+	}
+}
+
+func TestServeHTTPRequestDictionaryMissing(t *testing.T) {
+	InitWithStruct(Config{DictionaryDirectory: StrPtr("../testdata/dictionaries")})
+	called := false
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("compressed"))
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "missing")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	checkStatus(rr, http.StatusUnsupportedMediaType, t)
+	if called {
+		t.Errorf("Expected the wrapped handler not to be called")
+	}
+}
+
+func TestServeHTTPAbortedHandler(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	var completion *Completion
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic(http.ErrAbortHandler)
+	}), WithCompletionFunc(func(r *http.Request, c Completion) {
+		completion = &c
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set("Accept-Encoding", "szstd")
+	req.Header.Set("Available-Dictionary", "supply_chain")
+	rr := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("Expected the panic to reach the server, got %v", recovered)
+			}
+		}()
+		handler.ServeHTTP(rr, req)
+	}()
+
+	if completion == nil {
+		t.Fatalf("Expected the completion to be reported")
+	}
+	if completion.ResponseDictionaryId != "supply_chain" || completion.ResponseBytesIn != int64(len("partial")) {
+		t.Errorf("Unexpected completion %+v", *completion)
+	}
+}
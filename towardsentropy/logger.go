@@ -6,56 +6,108 @@
 
 package towardsentropy
 
-import "log"
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
 
+// Logger writes structured logs to Slog, dropping anything less severe than Level.
+// When Slog is nil, logs go to slog.Default(), which writes through the standard
+// log package unless slog.SetDefault was called. Its handler drops debug records
+// unless slog.SetLogLoggerLevel lowers its level.
 type Logger struct {
 	Level LogLevel
+	Slog  *slog.Logger
 }
 
-func (l *Logger) Debug(msg string) {
-	if l.Level >= LogLevelDebug {
-		log.Println("[DEBUG]", msg)
+func newLogger(config internalConfig) Logger {
+	return Logger{Level: config.LogLevel, Slog: config.Logger}
+}
+
+// WithLogAttrs returns a context whose attributes are added to every log record
+// the library writes for requests made or served with it.
+func WithLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsContextKey).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(combined, existing...)
+	combined = append(combined, attrs...)
+	return context.WithValue(ctx, logAttrsContextKey, combined)
+}
+
+func (l *Logger) log(ctx context.Context, level LogLevel, msg string, args ...any) {
+	if l.Level < level {
+		return
+	}
+	logger := l.Slog
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if attrs, ok := ctx.Value(logAttrsContextKey).([]slog.Attr); ok {
+		for _, attr := range attrs {
+			args = append(args, attr)
+		}
 	}
+	logger.Log(ctx, slogLevel(level), msg, args...)
 }
 
-func (l *Logger) Debugf(format string, v ...interface{}) {
-	if l.Level >= LogLevelDebug {
-		log.Printf("[DEBUG] "+format, v...)
+func slogLevel(level LogLevel) slog.Level {
+	switch level {
+	case LogLevelError:
+		return slog.LevelError
+	case LogLevelWarn:
+		return slog.LevelWarn
+	case LogLevelInfo:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
 	}
 }
 
+func (l *Logger) DebugContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, LogLevelDebug, msg, args...)
+}
+
+func (l *Logger) InfoContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, LogLevelInfo, msg, args...)
+}
+
+func (l *Logger) WarnContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, LogLevelWarn, msg, args...)
+}
+
+func (l *Logger) ErrorContext(ctx context.Context, msg string, args ...any) {
+	l.log(ctx, LogLevelError, msg, args...)
+}
+
+func (l *Logger) Debug(msg string) {
+	l.log(context.Background(), LogLevelDebug, msg)
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.log(context.Background(), LogLevelDebug, fmt.Sprintf(format, v...))
+}
+
 func (l *Logger) Info(msg string) {
-	if l.Level >= LogLevelInfo {
-		log.Println("[INFO]", msg)
-	}
+	l.log(context.Background(), LogLevelInfo, msg)
 }
 
 func (l *Logger) Infof(format string, v ...interface{}) {
-	if l.Level >= LogLevelInfo {
-		log.Printf("[INFO] "+format, v...)
-	}
+	l.log(context.Background(), LogLevelInfo, fmt.Sprintf(format, v...))
 }
 
 func (l *Logger) Warn(msg string) {
-	if l.Level >= LogLevelWarn {
-		log.Println("[WARN]", msg)
-	}
+	l.log(context.Background(), LogLevelWarn, msg)
 }
 
 func (l *Logger) Warnf(format string, v ...interface{}) {
-	if l.Level >= LogLevelWarn {
-		log.Printf("[WARN] "+format, v...)
-	}
+	l.log(context.Background(), LogLevelWarn, fmt.Sprintf(format, v...))
 }
 
 func (l *Logger) Error(msg string) {
-	if l.Level >= LogLevelError {
-		log.Println("[ERROR]", msg)
-	}
+	l.log(context.Background(), LogLevelError, msg)
 }
 
 func (l *Logger) Errorf(format string, v ...interface{}) {
-	if l.Level >= LogLevelError {
-		log.Printf("[ERROR] "+format, v...)
-	}
+	l.log(context.Background(), LogLevelError, fmt.Sprintf(format, v...))
 }
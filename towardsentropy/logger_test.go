@@ -0,0 +1,115 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := Logger{
+		Level: LogLevelWarn,
+		Slog:  slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+
+	logger.Debug("dropped")
+	logger.Infof("dropped %d", 1)
+	logger.Warnf("kept %d", 1)
+	logger.ErrorContext(context.Background(), "kept", "dictionary_id", "enwik8")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], `"level":"WARN","msg":"kept 1"`) {
+		t.Errorf("Unexpected warn line: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"level":"ERROR","msg":"kept","dictionary_id":"enwik8"`) {
+		t.Errorf("Unexpected error line: %s", lines[1])
+	}
+}
+
+func TestLoggerFollowsStandardLog(t *testing.T) {
+	var buf bytes.Buffer
+	output, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	}()
+
+	logger := Logger{Level: LogLevelWarn}
+	logger.WarnContext(context.Background(), "kept", "dictionary_id", "enwik8")
+
+	if got := buf.String(); got != "WARN kept dictionary_id=enwik8\n" {
+		t.Errorf("Expected the record through the standard logger, got %q", got)
+	}
+}
+
+func TestHandlerStructuredLogging(t *testing.T) {
+	var buf bytes.Buffer
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		LogLevel:            LogLevelPtr(LogLevelDebug),
+		Logger:              slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	InitWithStruct(Config{LogLevel: LogLevelPtr(LogLevelNone), Logger: slog.Default()})
+
+	// Attach a request scoped attribute the way an outer middleware would
+	request := func(r *http.Request) *http.Request {
+		return r.WithContext(WithLogAttrs(r.Context(), slog.String("request_id", "abc123")))
+	}
+	rr := executeRequest(withRequest(handler, request), "GET", "/test", []string{"zstd", "szstd"}, []string{"supply_chain"}, t)
+	checkBody("supply_chain", rr, "OK", t)
+
+	var record map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Could not parse log line %s: %v", line, err)
+		}
+		if record["msg"] == "Response complete" {
+			break
+		}
+	}
+	if record["msg"] != "Response complete" {
+		t.Fatalf("Missing completion log in %s", buf.String())
+	}
+	expected := map[string]interface{}{
+		"url":           "/test",
+		"encoding":      "szstd",
+		"dictionary_id": "supply_chain",
+		"bytes_in":      float64(2),
+		"request_id":    "abc123",
+	}
+	for k, v := range expected {
+		if record[k] != v {
+			t.Errorf("Unexpected %s: got %v, expected %v", k, record[k], v)
+		}
+	}
+	if _, ok := record["bytes_out"]; !ok {
+		t.Errorf("Missing bytes_out")
+	}
+}
+
+func withRequest(handler http.Handler, fn func(*http.Request) *http.Request) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, fn(r))
+	})
+}
@@ -0,0 +1,316 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources metrics are recorded from.
+const (
+	sourceDirect    = "direct"
+	sourceHandler   = "handler"
+	sourceTransport = "transport"
+)
+
+var (
+	durationBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	ratioBuckets    = []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.8, 1}
+)
+
+type metrics struct {
+	messages           *counterVec
+	uncompressedBytes  *counterVec
+	compressedBytes    *counterVec
+	compressDuration   *histogramVec
+	decompressDuration *histogramVec
+	compressionRatio   *histogramVec
+	negotiations       *counterVec
+	fallbacks          *counterVec
+	errors             *counterVec
+	collectors         []collector
+	publishExpvarOnce  sync.Once
+}
+
+type collector interface {
+	writePrometheus(w io.Writer)
+	expvarValue() interface{}
+	metricName() string
+}
+
+var defaultMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	streamLabels := []string{"source", "operation", "encoding", "dictionary"}
+	m := &metrics{
+		messages:           newCounterVec("towardsentropy_messages_total", "Messages compressed or decompressed.", streamLabels),
+		uncompressedBytes:  newCounterVec("towardsentropy_uncompressed_bytes_total", "Bytes before compression or after decompression.", streamLabels),
+		compressedBytes:    newCounterVec("towardsentropy_compressed_bytes_total", "Bytes after compression or before decompression.", streamLabels),
+		compressDuration:   newHistogramVec("towardsentropy_compress_duration_seconds", "Time spent compressing a message.", []string{"source", "encoding", "dictionary"}, durationBuckets),
+		decompressDuration: newHistogramVec("towardsentropy_decompress_duration_seconds", "Time spent decompressing a message.", []string{"source", "encoding", "dictionary"}, durationBuckets),
+		compressionRatio:   newHistogramVec("towardsentropy_compression_ratio", "Compressed size divided by uncompressed size.", streamLabels, ratioBuckets),
+		negotiations:       newCounterVec("towardsentropy_negotiations_total", "Encoding negotiation outcomes.", []string{"source", "outcome"}),
+		fallbacks:          newCounterVec("towardsentropy_fallbacks_total", "Times a dictionary could not be used.", []string{"source", "reason"}),
+		errors:             newCounterVec("towardsentropy_errors_total", "Errors while compressing or decompressing.", []string{"source", "operation"}),
+	}
+	m.collectors = []collector{
+		m.messages, m.uncompressedBytes, m.compressedBytes,
+		m.compressDuration, m.decompressDuration, m.compressionRatio,
+		m.negotiations, m.fallbacks, m.errors,
+	}
+	return m
+}
+
+// MetricsHandler returns a handler serving the library's metrics in the Prometheus text format.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		defaultMetrics.writePrometheus(w)
+	})
+}
+
+// PublishExpvar publishes the library's metrics as the "towardsentropy" expvar.
+// It is safe to call more than once.
+func PublishExpvar() {
+	defaultMetrics.publishExpvarOnce.Do(func() {
+		expvar.Publish("towardsentropy", expvar.Func(defaultMetrics.expvarValue))
+	})
+}
+
+func (m *metrics) writePrometheus(w io.Writer) {
+	for _, c := range m.collectors {
+		c.writePrometheus(w)
+	}
+}
+
+func (m *metrics) expvarValue() interface{} {
+	value := make(map[string]interface{})
+	for _, c := range m.collectors {
+		value[c.metricName()] = c.expvarValue()
+	}
+	return value
+}
+
+func (m *metrics) recordCompress(source string, dictionaryId string, uncompressed, compressed int64, elapsed time.Duration) {
+	encoding := string(encodingFor(dictionaryId))
+	m.recordStream(source, "compress", encoding, dictionaryId, uncompressed, compressed)
+	m.compressDuration.observe(elapsed.Seconds(), source, encoding, dictionaryId)
+}
+
+func (m *metrics) recordDecompress(source string, dictionaryId string, compressed, uncompressed int64, elapsed time.Duration) {
+	encoding := string(encodingFor(dictionaryId))
+	m.recordStream(source, "decompress", encoding, dictionaryId, uncompressed, compressed)
+	m.decompressDuration.observe(elapsed.Seconds(), source, encoding, dictionaryId)
+}
+
+func (m *metrics) recordStream(source, operation, encoding, dictionaryId string, uncompressed, compressed int64) {
+	m.messages.add(1, source, operation, encoding, dictionaryId)
+	m.uncompressedBytes.add(float64(uncompressed), source, operation, encoding, dictionaryId)
+	m.compressedBytes.add(float64(compressed), source, operation, encoding, dictionaryId)
+	if uncompressed > 0 {
+		m.compressionRatio.observe(float64(compressed)/float64(uncompressed), source, operation, encoding, dictionaryId)
+	}
+}
+
+func (m *metrics) recordNegotiation(source string, dictionaryId string) {
+	outcome := "dictionary"
+	if dictionaryId == "" {
+		outcome = "plain"
+	}
+	m.negotiations.add(1, source, outcome)
+}
+
+func (m *metrics) recordFallback(source, reason string) {
+	m.fallbacks.add(1, source, reason)
+}
+
+func (m *metrics) recordError(source, operation string) {
+	m.errors.add(1, source, operation)
+}
+
+func encodingFor(dictionaryId string) CompressionType {
+	if dictionaryId == "" {
+		return Zstd
+	}
+	return SharedZstd
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels []string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labelValues: labelValues}
+		c.values[key] = value
+	}
+	value.value += v
+}
+
+func (c *counterVec) get(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return value.value
+	}
+	return 0
+}
+
+func (c *counterVec) metricName() string { return c.name }
+
+func (c *counterVec) writePrometheus(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, value.labelValues, ""), formatFloat(value.value))
+	}
+}
+
+func (c *counterVec) expvarValue() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]float64)
+	for _, value := range c.values {
+		values[formatLabels(c.labels, value.labelValues, "")] = value.value
+	}
+	return values
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, labels []string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		value = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = value
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			value.counts[i]++
+		}
+	}
+	value.sum += v
+	value.count++
+}
+
+func (h *histogramVec) metricName() string { return h.name }
+
+func (h *histogramVec) writePrometheus(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		value := h.values[key]
+		for i, bound := range h.buckets {
+			labels := formatLabels(h.labels, value.labelValues, formatFloat(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, value.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, value.labelValues, "+Inf"), value.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, value.labelValues, ""), formatFloat(value.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, value.labelValues, ""), value.count)
+	}
+}
+
+func (h *histogramVec) expvarValue() interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	values := make(map[string]interface{})
+	for _, value := range h.values {
+		buckets := make(map[string]uint64)
+		for i, bound := range h.buckets {
+			buckets[formatFloat(bound)] = value.counts[i]
+		}
+		values[formatLabels(h.labels, value.labelValues, "")] = map[string]interface{}{
+			"buckets": buckets,
+			"sum":     value.sum,
+			"count":   value.count,
+		}
+	}
+	return values
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label pairs the Prometheus way, adding an le label when set.
+func formatLabels(names, values []string, le string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
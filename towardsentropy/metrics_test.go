@@ -0,0 +1,100 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCompress(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	before := defaultMetrics.messages.get(sourceDirect, "compress", "szstd", "supply_chain")
+	beforeBytes := defaultMetrics.uncompressedBytes.get(sourceDirect, "compress", "szstd", "supply_chain")
+
+	body := getBody()
+	var compressed bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &compressed, "supply_chain"); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+
+	if got := defaultMetrics.messages.get(sourceDirect, "compress", "szstd", "supply_chain") - before; got != 1 {
+		t.Errorf("Expected 1 message recorded, got %v", got)
+	}
+	if got := defaultMetrics.uncompressedBytes.get(sourceDirect, "compress", "szstd", "supply_chain") - beforeBytes; got != float64(len(body)) {
+		t.Errorf("Expected %d uncompressed bytes recorded, got %v", len(body), got)
+	}
+
+	before = defaultMetrics.errors.get(sourceDirect, "compress")
+	Compress(bytes.NewReader(body), io.Discard, "missing")
+	if got := defaultMetrics.errors.get(sourceDirect, "compress") - before; got != 1 {
+		t.Errorf("Expected 1 error recorded, got %v", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	before := defaultMetrics.fallbacks.get(sourceHandler, "no_dictionary_offered")
+	executeRequest(handler, "GET", "/test", []string{"zstd", "szstd"}, []string{}, t)
+	executeRequest(handler, "GET", "/test", []string{"zstd", "szstd"}, []string{"supply_chain"}, t)
+	if got := defaultMetrics.fallbacks.get(sourceHandler, "no_dictionary_offered") - before; got != 1 {
+		t.Errorf("Expected 1 fallback recorded, got %v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	text := rr.Body.String()
+	expected := []string{
+		"# TYPE towardsentropy_messages_total counter",
+		`towardsentropy_messages_total{source="handler",operation="compress",encoding="szstd",dictionary="supply_chain"}`,
+		"# TYPE towardsentropy_compress_duration_seconds histogram",
+		`towardsentropy_compress_duration_seconds_bucket{source="handler",encoding="szstd",dictionary="supply_chain",le="+Inf"}`,
+		`towardsentropy_negotiations_total{source="handler",outcome="dictionary"}`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(text, line) {
+			t.Errorf("Expected metrics to contain %s", line)
+		}
+	}
+}
+
+func TestPublishExpvar(t *testing.T) {
+	PublishExpvar()
+	PublishExpvar()
+
+	v := expvar.Get("towardsentropy")
+	if v == nil {
+		t.Fatalf("Expected towardsentropy expvar")
+	}
+	var value map[string]interface{}
+	if err := json.Unmarshal([]byte(v.String()), &value); err != nil {
+		t.Fatalf("Could not parse expvar: %v", err)
+	}
+	if _, ok := value["towardsentropy_messages_total"]; !ok {
+		t.Errorf("Expected towardsentropy_messages_total in expvar")
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	got := formatLabels([]string{"a", "b"}, []string{`x"y`, "z\\"}, "0.5")
+	expected := `{a="x\"y",b="z\\",le="0.5"}`
+	if got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"context"
+	"net/http"
+)
+
+// Negotiation describes how TowardsEntropyHandler encodes a request body and its response.
+type Negotiation struct {
+	RequestEncoding      CompressionType // Encoding of the request body, "" when uncompressed
+	RequestDictionaryId  string          // Dictionary the request body was compressed with
+	ResponseEncoding     CompressionType // Encoding the response is compressed with
+	ResponseDictionaryId string          // Dictionary the response is compressed with
+}
+
+// Completion is passed to the completion callback once a response has been written.
+type Completion struct {
+	Negotiation
+	RequestBytesIn   int64 // Request body bytes read from the client
+	RequestBytesOut  int64 // Request body bytes read by the wrapped handler after decompression
+	ResponseBytesIn  int64 // Response bytes written by the wrapped handler
+	ResponseBytesOut int64 // Response bytes written to the client after compression
+}
+
+// CompletionFunc is called by TowardsEntropyHandler after each response.
+type CompletionFunc func(r *http.Request, completion Completion)
+
+// HandlerOption configures a TowardsEntropyHandler.
+type HandlerOption func(*TowardsEntropyHandler)
+
+// WithCompletionFunc makes the handler call fn after each response it writes.
+func WithCompletionFunc(fn CompletionFunc) HandlerOption {
+	return func(h *TowardsEntropyHandler) {
+		h.onComplete = fn
+	}
+}
+
+// NegotiationFromContext returns the negotiation for a request served by
+// TowardsEntropyHandler. Wrapped handlers can call it with r.Context().
+func NegotiationFromContext(ctx context.Context) (*Negotiation, bool) {
+	negotiation, ok := ctx.Value(negotiationContextKey).(*Negotiation)
+	return negotiation, ok
+}
+
+func withNegotiation(ctx context.Context, negotiation *Negotiation) context.Context {
+	return context.WithValue(ctx, negotiationContextKey, negotiation)
+}
@@ -0,0 +1,91 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiationContextAndCompletion(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+
+	body := getBody()
+	var compressed bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &compressed, "supply_chain"); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+	compressedLength := int64(compressed.Len())
+
+	var seen *Negotiation
+	baseHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = NegotiationFromContext(r.Context())
+		received, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Could not read request body: %v", err)
+		}
+		w.Write(received)
+	})
+
+	var completion Completion
+	completed := false
+	handler := NewTowardsEntropyHandler(baseHandler, WithCompletionFunc(func(r *http.Request, c Completion) {
+		completion = c
+		completed = true
+	}))
+
+	req, err := http.NewRequest(http.MethodPost, "/upload", &compressed)
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "supply_chain")
+	req.Header.Add("Accept-Encoding", string(SharedZstd))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	responseLength := int64(rr.Body.Len())
+	checkBody("supply_chain", rr, string(body), t)
+
+	if seen == nil {
+		t.Fatalf("Expected negotiation in request context")
+	}
+	expected := Negotiation{
+		RequestEncoding:      SharedZstd,
+		RequestDictionaryId:  "supply_chain",
+		ResponseEncoding:     SharedZstd,
+		ResponseDictionaryId: "supply_chain",
+	}
+	if *seen != expected {
+		t.Errorf("Unexpected negotiation: got %+v, expected %+v", *seen, expected)
+	}
+
+	if !completed {
+		t.Fatalf("Expected completion callback")
+	}
+	if completion.Negotiation != expected {
+		t.Errorf("Unexpected completion negotiation: %+v", completion.Negotiation)
+	}
+	if completion.RequestBytesIn != compressedLength {
+		t.Errorf("Unexpected RequestBytesIn: got %d, expected %d", completion.RequestBytesIn, compressedLength)
+	}
+	if completion.RequestBytesOut != int64(len(body)) {
+		t.Errorf("Unexpected RequestBytesOut: got %d, expected %d", completion.RequestBytesOut, len(body))
+	}
+	if completion.ResponseBytesIn != int64(len(body)) {
+		t.Errorf("Unexpected ResponseBytesIn: got %d, expected %d", completion.ResponseBytesIn, len(body))
+	}
+	if completion.ResponseBytesOut != responseLength {
+		t.Errorf("Unexpected ResponseBytesOut: got %d, expected %d", completion.ResponseBytesOut, responseLength)
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import "net/http"
+
+// TransportOption configures a TowardsEntropyTransport.
+type TransportOption func(*TowardsEntropyTransport)
+
+// WithResponsePassthrough makes the transport return zstd and szstd responses
+// still compressed, with their Content-Encoding and Dictionary-Id headers, for
+// proxies whose clients decompress them. Negotiation headers already on a
+// request are sent as they are, so the server picks a dictionary the client
+// has, and request bodies that already have a Content-Encoding are not
+// compressed again. WithCompressedResponse does the same for one request.
+func WithResponsePassthrough() TransportOption {
+	return func(t *TowardsEntropyTransport) {
+		t.passthrough = true
+	}
+}
+
+// WithCompressedPassthrough makes the handler forward zstd and szstd request
+// bodies to the wrapped handler byte for byte, keeping their encoding headers,
+// instead of decompressing them. The wrapped handler must decode them itself,
+// usually by passing them on to a server that does. Responses the wrapped
+// handler has already encoded are forwarded byte for byte either way.
+func WithCompressedPassthrough() HandlerOption {
+	return func(h *TowardsEntropyHandler) {
+		h.passthrough = true
+	}
+}
+
+func (t *TowardsEntropyTransport) passthroughFor(req *http.Request) bool {
+	return t.passthrough || compressedResponseInContext(req.Context())
+}
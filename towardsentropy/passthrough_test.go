@@ -0,0 +1,163 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type CompressedRoundTripper struct {
+	request *http.Request
+	body    []byte
+}
+
+func (m *CompressedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.request = req
+	header := http.Header{}
+	header.Set("Content-Encoding", string(SharedZstd))
+	header.Set("Dictionary-Id", "supply_chain")
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(m.body)),
+	}, nil
+}
+
+func TestTransportResponsePassthrough(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &compressed, "supply_chain")
+
+	tests := []struct {
+		name      string
+		transport *TowardsEntropyTransport
+		ctx       context.Context
+	}{
+		{"option", NewTowardsEntropyTransport(nil, WithResponsePassthrough()), context.Background()},
+		{"context", NewTowardsEntropyTransport(nil), WithCompressedResponse(context.Background())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &CompressedRoundTripper{body: compressed.Bytes()}
+			tt.transport.base = base
+			req, _ := http.NewRequestWithContext(tt.ctx, http.MethodGet, "http://example.com", nil)
+			req.Header.Set("Accept-Encoding", "szstd")
+			req.Header.Set("Available-Dictionary", "enwik8")
+			resp, err := tt.transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip failed: %v", err)
+			}
+
+			if values := base.request.Header.Values("Available-Dictionary"); len(values) != 1 || values[0] != "enwik8" {
+				t.Errorf("Expected the negotiation headers of the request, got %v", values)
+			}
+			if resp.Header.Get("Content-Encoding") != string(SharedZstd) || resp.Header.Get("Dictionary-Id") != "supply_chain" || resp.Uncompressed {
+				t.Errorf("Expected the encoding headers to be kept, got %v", resp.Header)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(body, compressed.Bytes()) {
+				t.Errorf("Expected the compressed body")
+			}
+		})
+	}
+
+	// Without passthrough the same response is decompressed
+	base := &CompressedRoundTripper{body: compressed.Bytes()}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	resp, err := NewTowardsEntropyTransport(base).RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, getBody()) || !resp.Uncompressed {
+		t.Errorf("Expected a decompressed response")
+	}
+}
+
+func TestTransportRequestPassthrough(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	base := &RecordingRoundTripper{}
+	transport := NewTowardsEntropyTransport(base, WithResponsePassthrough())
+	body := []byte("already compressed")
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "enwik8")
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+
+	if !bytes.Equal(base.bodies[0], body) || base.requests[0].Header.Get("Dictionary-Id") != "enwik8" {
+		t.Errorf("Expected the body to be sent untouched, got %q with %v", base.bodies[0], base.requests[0].Header)
+	}
+}
+
+func TestCompressedPassthroughProxy(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	var response bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &response, "supply_chain")
+	var upstreamHeader http.Header
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Encoding", string(SharedZstd))
+		w.Header().Set("Dictionary-Id", "supply_chain")
+		w.Write(response.Bytes())
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	var completion Completion
+	proxy := httptest.NewServer(NewTowardsEntropyProxy(upstreamURL, WithCompressedPassthrough(), WithCompletionFunc(func(r *http.Request, c Completion) {
+		completion = c
+	})))
+	defer proxy.Close()
+
+	// The proxy has not loaded the dictionary, the upstream decodes the body
+	body := []byte("compressed with a dictionary only the upstream has")
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/upload", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "upstream_only")
+	req.Header.Set("Accept-Encoding", "zstd, szstd")
+	req.Header.Set("Available-Dictionary", "supply_chain")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	if !bytes.Equal(upstreamBody, body) || upstreamHeader.Get("Content-Encoding") != string(SharedZstd) || upstreamHeader.Get("Dictionary-Id") != "upstream_only" {
+		t.Errorf("Expected the upstream to receive the body untouched, got %q with %v", upstreamBody, upstreamHeader)
+	}
+	if upstreamHeader.Get("Available-Dictionary") != "supply_chain" {
+		t.Errorf("Expected the negotiation headers to reach the upstream, got %v", upstreamHeader)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(got, response.Bytes()) || resp.Header.Get("Dictionary-Id") != "supply_chain" {
+		t.Errorf("Expected the upstream response byte for byte, got %v", resp.Header)
+	}
+	if completion.RequestDictionaryId != "upstream_only" || completion.RequestBytesIn != completion.RequestBytesOut {
+		t.Errorf("Unexpected completion %+v", completion)
+	}
+}
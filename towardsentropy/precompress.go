@@ -0,0 +1,314 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultManifestName is the manifest Precompress keeps in the root directory.
+// It lists every file with its hash, so CompressedFileServer does not serve it.
+const DefaultManifestName = ".towardsentropy-manifest.json"
+
+// PrecompressOptions configures Precompress.
+type PrecompressOptions struct {
+	Plain    bool   // Also write name.zst, compressed without a dictionary
+	Force    bool   // Compress every file again, ignoring the manifest
+	Manifest string // Manifest path, DefaultManifestName in the root when empty
+}
+
+// PrecompressedFile describes what Precompress did with one file.
+type PrecompressedFile struct {
+	Path      string           // Path relative to the root, with forward slashes
+	Size      int64            // Size of the original
+	PlainSize int64            // Size compressed with plain zstd
+	Siblings  map[string]int64 // Size of each sibling written, keyed by dictionary id, "" for plain
+	Rejected  []string         // Matching dictionaries that did not beat plain zstd
+	Unchanged bool             // Whether the siblings from an earlier run were kept
+}
+
+type precompressManifest struct {
+	Files map[string]manifestEntry
+}
+
+type manifestEntry struct {
+	Size      int64
+	ModTime   int64
+	Hash      string
+	Level     int
+	FrameSize int
+	Plain     bool
+	Inputs    map[string]string // Hash of each matching dictionary
+	Result    PrecompressedFile
+}
+
+// Precompress walks root and writes compressed siblings that
+// CompressedFileServer can serve: name.<dictionary id>.szst for each loaded
+// dictionary whose DictionaryMatchMap rule matches "/" + the relative path, and
+// name.zst when opts.Plain is set. A dictionary sibling is only kept when it is
+// smaller than plain zstd. Siblings next to their original are not compressed
+// again, other .zst and .szst files are.
+//
+// A manifest records each file's size, modification time and hash along with
+// the dictionaries and settings used, so files are only compressed again when
+// one of them changes.
+func Precompress(root string, opts PrecompressOptions) ([]PrecompressedFile, error) {
+	config := getConfig()
+	manifestPath := opts.Manifest
+	if manifestPath == "" {
+		manifestPath = filepath.Join(root, DefaultManifestName)
+	}
+	manifest := readManifest(manifestPath)
+	outputs := manifestOutputs(root, manifest)
+	if opts.Force {
+		manifest.Files = make(map[string]manifestEntry)
+	}
+	previous := manifest.Files
+	manifest.Files = make(map[string]manifestEntry)
+
+	results := make([]PrecompressedFile, 0)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isPrecompressOutput(path, manifestPath, outputs) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		entry, err := precompressFile(path, rel, previous[rel], config, opts)
+		if err != nil {
+			return fmt.Errorf("could not precompress %s: %v", rel, err)
+		}
+		manifest.Files[rel] = entry
+		results = append(results, entry.Result)
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+	return results, writeManifest(manifestPath, manifest)
+}
+
+// manifestOutputs returns the siblings an earlier run recorded in manifest.
+func manifestOutputs(root string, manifest precompressManifest) map[string]bool {
+	outputs := make(map[string]bool)
+	for rel, entry := range manifest.Files {
+		for _, sibling := range siblingPaths(filepath.Join(root, filepath.FromSlash(rel)), entry.Result) {
+			outputs[sibling] = true
+		}
+	}
+	return outputs
+}
+
+// isPrecompressOutput reports whether path was written by Precompress: the
+// manifest, a sibling it lists, or name.zst and name.<dictionary id>.szst next
+// to an existing name, which covers siblings from a run whose manifest is gone.
+// Other .zst and .szst files are compressed like any file. Leftover temporary
+// files of outputs count as outputs.
+func isPrecompressOutput(path, manifestPath string, outputs map[string]bool) bool {
+	path = filepath.Clean(path)
+	if path == filepath.Clean(manifestPath) || outputs[path] {
+		return true
+	}
+	if base, ok := strings.CutSuffix(path, ".tmp"); ok {
+		return isPrecompressOutput(base, manifestPath, outputs)
+	}
+	if base, ok := strings.CutSuffix(path, ".zst"); ok {
+		return isRegularFile(base)
+	}
+	if base, ok := strings.CutSuffix(path, ".szst"); ok {
+		// Dictionary ids may contain dots, try every split
+		for i := strings.LastIndex(base, "."); i > 0; i = strings.LastIndex(base[:i], ".") {
+			if isRegularFile(base[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isRegularFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func precompressFile(path, rel string, previous manifestEntry, config internalConfig, opts PrecompressOptions) (manifestEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	inputs := make(map[string]string)
+	for _, id := range dictionariesMatching(config, "/"+rel, dictionaryIds()) {
+		inputs[id] = getDictionary(id).Hash()
+	}
+	entry := manifestEntry{
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+		Level:     config.CompressionLevel,
+		FrameSize: config.FrameSize,
+		Plain:     opts.Plain,
+		Inputs:    inputs,
+	}
+
+	sameSettings := previous.Level == entry.Level && previous.FrameSize == entry.FrameSize &&
+		previous.Plain == entry.Plain && sameInputs(previous.Inputs, inputs) && siblingsExist(path, previous.Result)
+	if sameSettings && previous.Size == entry.Size && previous.ModTime == entry.ModTime {
+		entry.Hash = previous.Hash
+		entry.Result = previous.Result
+		entry.Result.Unchanged = true
+		return entry, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	sum := sha256.Sum256(data)
+	entry.Hash = hex.EncodeToString(sum[:])
+	if sameSettings && previous.Hash == entry.Hash {
+		// Touched but not modified, keep the siblings from looking stale
+		for _, sibling := range siblingPaths(path, previous.Result) {
+			if err := os.Chtimes(sibling, info.ModTime(), info.ModTime()); err != nil {
+				return manifestEntry{}, err
+			}
+		}
+		entry.Result = previous.Result
+		entry.Result.Unchanged = true
+		return entry, nil
+	}
+
+	result := PrecompressedFile{Path: rel, Size: info.Size(), Siblings: make(map[string]int64), Rejected: make([]string, 0)}
+	plain, err := compressToBytes(data, nil, config)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	result.PlainSize = int64(len(plain))
+	if opts.Plain {
+		if err := writeSibling(path+".zst", plain); err != nil {
+			return manifestEntry{}, err
+		}
+		result.Siblings[""] = result.PlainSize
+	} else {
+		os.Remove(path + ".zst")
+	}
+
+	ids := make([]string, 0, len(inputs))
+	for id := range inputs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		sibling := path + "." + id + ".szst"
+		compressed, err := compressToBytes(data, getDictionary(id), config)
+		if err != nil {
+			return manifestEntry{}, err
+		}
+		if len(compressed) >= len(plain) {
+			result.Rejected = append(result.Rejected, id)
+			os.Remove(sibling)
+			continue
+		}
+		if err := writeSibling(sibling, compressed); err != nil {
+			return manifestEntry{}, err
+		}
+		result.Siblings[id] = int64(len(compressed))
+	}
+	// Siblings for dictionaries that no longer match are stale
+	for id := range previous.Result.Siblings {
+		if _, ok := inputs[id]; !ok && id != "" {
+			os.Remove(path + "." + id + ".szst")
+		}
+	}
+
+	entry.Result = result
+	return entry, nil
+}
+
+func compressToBytes(data []byte, dictionary *Dictionary, config internalConfig) ([]byte, error) {
+	var out bytes.Buffer
+	if _, err := compress(context.Background(), bytes.NewReader(data), &out, dictionary, config); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// writeSibling replaces path through a temporary file so readers never see it half written.
+func writeSibling(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func sameInputs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, hash := range a {
+		if b[id] != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// siblingPaths returns the paths of the siblings result lists for path.
+func siblingPaths(path string, result PrecompressedFile) []string {
+	paths := make([]string, 0, len(result.Siblings))
+	for id := range result.Siblings {
+		if id == "" {
+			paths = append(paths, path+".zst")
+		} else {
+			paths = append(paths, path+"."+id+".szst")
+		}
+	}
+	return paths
+}
+
+func siblingsExist(path string, result PrecompressedFile) bool {
+	for _, sibling := range siblingPaths(path, result) {
+		if _, err := os.Stat(sibling); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func readManifest(path string) precompressManifest {
+	manifest := precompressManifest{Files: make(map[string]manifestEntry)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifest
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Files == nil {
+		return precompressManifest{Files: make(map[string]manifestEntry)}
+	}
+	return manifest
+}
+
+func writeManifest(path string, manifest precompressManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeSibling(path, data)
+}
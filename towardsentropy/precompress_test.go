@@ -0,0 +1,127 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func precompressedByPath(files []PrecompressedFile) map[string]PrecompressedFile {
+	byPath := make(map[string]PrecompressedFile)
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+	return byPath
+}
+
+func TestPrecompress(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"/data/*": "supply_chain", "/logs/*": "enwik8"}),
+	})
+	defer InitWithStruct(Config{DictionaryMatchMap: MapPtr(map[string]string{})})
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "data"), 0755)
+	body := getBody()
+	csv := filepath.Join(dir, "data", "emissions.csv")
+	os.WriteFile(csv, body, 0644)
+	os.WriteFile(filepath.Join(dir, "data", "tiny.txt"), []byte("hi"), 0644)
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644)
+
+	files, err := Precompress(dir, PrecompressOptions{Plain: true})
+	if err != nil {
+		t.Fatalf("Could not precompress: %v", err)
+	}
+	byPath := precompressedByPath(files)
+	if len(byPath) != 3 {
+		t.Fatalf("Expected 3 files, got %v", files)
+	}
+	if _, ok := byPath["data/emissions.csv"].Siblings["supply_chain"]; !ok {
+		t.Errorf("Expected a supply_chain sibling for the csv: %+v", byPath["data/emissions.csv"])
+	}
+	if rejected := byPath["data/tiny.txt"].Rejected; len(rejected) != 1 || rejected[0] != "supply_chain" {
+		t.Errorf("Expected the dictionary to lose to plain zstd for a tiny file: %+v", byPath["data/tiny.txt"])
+	}
+	if _, err := os.Stat(filepath.Join(dir, "data", "tiny.txt.supply_chain.szst")); !os.IsNotExist(err) {
+		t.Errorf("Expected no sibling for a rejected dictionary")
+	}
+	if len(byPath["index.html"].Siblings) != 1 {
+		t.Errorf("Expected only a plain sibling outside the matching rule: %+v", byPath["index.html"])
+	}
+
+	compressed, _ := os.ReadFile(csv + ".supply_chain.szst")
+	var out bytes.Buffer
+	if err := Decompress(bytes.NewReader(compressed), &out, "supply_chain"); err != nil || !bytes.Equal(out.Bytes(), body) {
+		t.Errorf("Sibling does not decompress to the original: %v", err)
+	}
+
+	// A rerun, then a touch, leave everything in place
+	files, _ = Precompress(dir, PrecompressOptions{Plain: true})
+	for _, file := range files {
+		if !file.Unchanged {
+			t.Errorf("Expected %s to be unchanged on rerun", file.Path)
+		}
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(csv, later, later)
+	files, _ = Precompress(dir, PrecompressOptions{Plain: true})
+	if !precompressedByPath(files)["data/emissions.csv"].Unchanged {
+		t.Errorf("Expected a touched file with the same contents to be unchanged")
+	}
+	original, _ := os.Stat(csv)
+	if sibling, _ := os.Stat(csv + ".supply_chain.szst"); sibling.ModTime().Before(original.ModTime()) {
+		t.Errorf("Expected the kept sibling to be no older than the original, got %v", sibling.ModTime())
+	}
+
+	// Changing the contents compresses again
+	os.WriteFile(csv, append(body, body...), 0644)
+	files, _ = Precompress(dir, PrecompressOptions{Plain: true})
+	if file := precompressedByPath(files)["data/emissions.csv"]; file.Unchanged || file.Size != int64(2*len(body)) {
+		t.Errorf("Expected a modified file to be compressed again: %+v", file)
+	}
+}
+
+func TestPrecompressOutputs(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	defer InitWithStruct(Config{DictionaryMatchMap: MapPtr(map[string]string{})})
+	dir := t.TempDir()
+	body := getBody()
+	os.WriteFile(filepath.Join(dir, "data.csv"), body, 0644)
+	var archive bytes.Buffer
+	Compress(bytes.NewReader(body), &archive, "")
+	os.WriteFile(filepath.Join(dir, "archive.zst"), archive.Bytes(), 0644)
+
+	files, err := Precompress(dir, PrecompressOptions{Plain: true})
+	if err != nil {
+		t.Fatalf("Could not precompress: %v", err)
+	}
+	byPath := precompressedByPath(files)
+	if len(byPath) != 2 {
+		t.Fatalf("Expected the csv and the archive, got %v", files)
+	}
+	if _, ok := byPath["archive.zst"]; !ok {
+		t.Errorf("Expected a .zst file without an original to be precompressed: %v", files)
+	}
+
+	// Siblings from a run whose manifest is gone are still recognized
+	os.Remove(filepath.Join(dir, DefaultManifestName))
+	os.WriteFile(filepath.Join(dir, "data.csv.supply_chain.szst.tmp"), []byte("partial"), 0644)
+	files, err = Precompress(dir, PrecompressOptions{Plain: true})
+	if err != nil {
+		t.Fatalf("Could not precompress: %v", err)
+	}
+	if byPath := precompressedByPath(files); len(byPath) != 2 {
+		t.Errorf("Expected only the csv and the archive, got %v", files)
+	}
+}
@@ -0,0 +1,39 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"net/http/httputil"
+	"net/url"
+)
+
+// NewTowardsEntropyProxy returns a TowardsEntropyHandler in front of a reverse
+// proxy to upstream, so services that do not speak szstd get dictionary
+// compression. Request bodies are decompressed before they are forwarded and
+// responses are compressed on the way back. The Host header of the request is
+// kept.
+//
+// The negotiation headers are not forwarded, so the upstream answers with an
+// identity or gzip body for the handler to compress. A response the upstream
+// encoded anyway is passed through untouched. With WithCompressedPassthrough,
+// compressed request bodies and the negotiation headers are forwarded as they
+// are, so an upstream that speaks szstd itself compresses for the client.
+func NewTowardsEntropyProxy(upstream *url.URL, opts ...HandlerOption) *TowardsEntropyHandler {
+	h := NewTowardsEntropyHandler(nil, opts...)
+	h.baseHandler = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(upstream)
+			r.SetXForwarded()
+			r.Out.Host = r.In.Host
+			if !h.passthrough {
+				r.Out.Header.Del("Accept-Encoding")
+				r.Out.Header.Del("Available-Dictionary")
+			}
+		},
+	}
+	return h
+}
@@ -0,0 +1,65 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTowardsEntropyProxy(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	var upstreamHeader http.Header
+	var upstreamBody []byte
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		upstreamBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write(upstreamBody)
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	proxy := httptest.NewServer(NewTowardsEntropyProxy(upstreamURL))
+	defer proxy.Close()
+
+	body := getBody()
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(body), &compressed, "supply_chain")
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL+"/upload", bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "supply_chain")
+	req.Header.Set("Accept-Encoding", "zstd, szstd")
+	req.Header.Set("Available-Dictionary", "supply_chain")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if !bytes.Equal(upstreamBody, body) {
+		t.Errorf("Expected the upstream to receive the decompressed body")
+	}
+	for _, name := range []string{"Content-Encoding", "Dictionary-Id", "Available-Dictionary"} {
+		if upstreamHeader.Get(name) != "" {
+			t.Errorf("Expected %s not to reach the upstream, got %s", name, upstreamHeader.Get(name))
+		}
+	}
+	if resp.Header.Get("Content-Encoding") != string(SharedZstd) || resp.Header.Get("Dictionary-Id") != "supply_chain" {
+		t.Fatalf("Expected a szstd response, got %v", resp.Header)
+	}
+	var out bytes.Buffer
+	if err := Decompress(resp.Body, &out, "supply_chain"); err != nil || !bytes.Equal(out.Bytes(), body) {
+		t.Errorf("Unexpected response body: %v", err)
+	}
+}
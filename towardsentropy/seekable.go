@@ -0,0 +1,499 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/DataDog/zstd"
+)
+
+// The seek table follows the zstd seekable format: a skippable frame holding a
+// compressed and decompressed size per frame, ending in a footer with the frame
+// count and a magic number, so it can be found from the end of the stream.
+const (
+	seekTableMagic       uint32 = 0x184D2A5E
+	seekableMagic        uint32 = 0x8F92EAB1
+	seekTableFooterSize         = 9
+	seekTableChecksumBit        = 0x80
+)
+
+// ErrNoSeekTable is returned when a stream does not end in a seek table.
+var ErrNoSeekTable = errors.New("stream has no seek table")
+
+// SeekTable locates the frames of a stream written with a FrameSize.
+type SeekTable struct {
+	Frames []SeekTableEntry
+}
+
+// SeekTableEntry locates one frame.
+type SeekTableEntry struct {
+	CompressedOffset   int64
+	CompressedSize     int64
+	DecompressedOffset int64
+	DecompressedSize   int64
+}
+
+// DecompressedSize returns the size of the whole stream once decompressed.
+func (t *SeekTable) DecompressedSize() int64 {
+	if len(t.Frames) == 0 {
+		return 0
+	}
+	last := t.Frames[len(t.Frames)-1]
+	return last.DecompressedOffset + last.DecompressedSize
+}
+
+// encoder is the part of zstd.Writer compress and Writer use.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoder returns a zstd encoder writing to w, starting a new frame every
+// frameSize bytes and ending with a seek table when frameSize is positive.
+func newEncoder(w io.Writer, dictionary *Dictionary, level, workers, frameSize int) (encoder, error) {
+	if frameSize > math.MaxUint32 {
+		return nil, fmt.Errorf("frame size %d is too large for a seek table", frameSize)
+	}
+	if frameSize > 0 {
+		return &frameWriter{
+			out:        &countingWriter{Writer: w},
+			dictionary: dictionary,
+			level:      level,
+			workers:    workers,
+			frameSize:  frameSize,
+		}, nil
+	}
+	var zw *zstd.Writer
+	if dictionary == nil {
+		zw = zstd.NewWriterLevel(w, level)
+	} else {
+		zw = zstd.NewWriterLevelDict(w, level, dictionary.Bytes)
+	}
+	if err := setWorkers(zw, workers); err != nil {
+		return nil, err
+	}
+	return zw, nil
+}
+
+// encodedFrames returns the number of zstd frames a closed encoder wrote.
+func encodedFrames(zw encoder) int {
+	if f, ok := zw.(*frameWriter); ok {
+		return len(f.entries)
+	}
+	return 1
+}
+
+// frameWriter compresses every frameSize bytes into an independent frame and
+// records each one for the seek table written by Close.
+type frameWriter struct {
+	out        *countingWriter
+	dictionary *Dictionary
+	level      int
+	workers    int
+	frameSize  int
+	zw         encoder
+	frameStart int64 // Compressed offset of the current frame
+	frameBytes int   // Uncompressed bytes in the current frame
+	entries    []SeekTableEntry
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if f.zw == nil {
+			zw, err := newEncoder(f.out, f.dictionary, f.level, f.workers, 0)
+			if err != nil {
+				return written, err
+			}
+			f.zw = zw
+			f.frameStart = f.out.count
+		}
+		n := f.frameSize - f.frameBytes
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := f.zw.Write(p[:n]); err != nil {
+			return written, err
+		}
+		f.frameBytes += n
+		written += n
+		p = p[n:]
+		if f.frameBytes == f.frameSize {
+			if err := f.endFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (f *frameWriter) endFrame() error {
+	err := f.zw.Close()
+	f.zw = nil
+	if err != nil {
+		return err
+	}
+	entry := SeekTableEntry{
+		CompressedOffset: f.frameStart,
+		CompressedSize:   f.out.count - f.frameStart,
+		DecompressedSize: int64(f.frameBytes),
+	}
+	if len(f.entries) > 0 {
+		previous := f.entries[len(f.entries)-1]
+		entry.DecompressedOffset = previous.DecompressedOffset + previous.DecompressedSize
+	}
+	if entry.CompressedSize > math.MaxUint32 {
+		return fmt.Errorf("frame at offset %d is too large for a seek table", entry.CompressedOffset)
+	}
+	f.entries = append(f.entries, entry)
+	f.frameBytes = 0
+	return nil
+}
+
+func (f *frameWriter) Flush() error {
+	if f.zw == nil {
+		return nil
+	}
+	return f.zw.Flush()
+}
+
+// Close ends the current frame and writes the seek table.
+func (f *frameWriter) Close() error {
+	if f.zw != nil {
+		if err := f.endFrame(); err != nil {
+			return err
+		}
+	}
+	_, err := f.out.Write(appendSeekTable(nil, f.entries))
+	return err
+}
+
+func appendSeekTable(b []byte, entries []SeekTableEntry) []byte {
+	b = binary.LittleEndian.AppendUint32(b, seekTableMagic)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(entries)*8+seekTableFooterSize))
+	for _, entry := range entries {
+		b = binary.LittleEndian.AppendUint32(b, uint32(entry.CompressedSize))
+		b = binary.LittleEndian.AppendUint32(b, uint32(entry.DecompressedSize))
+	}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(entries)))
+	b = append(b, 0)
+	return binary.LittleEndian.AppendUint32(b, seekableMagic)
+}
+
+// readFullAt fills p from off. io.ReaderAt may return io.EOF along with a full
+// read that ends at the end of the input, where the seek table sits.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadSeekTable reads the seek table at the end of a stream of size bytes.
+func ReadSeekTable(r io.ReaderAt, size int64) (*SeekTable, error) {
+	if size < 8+seekTableFooterSize {
+		return nil, ErrNoSeekTable
+	}
+	footer := make([]byte, seekTableFooterSize)
+	if err := readFullAt(r, footer, size-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, ErrNoSeekTable
+	}
+	count := int64(binary.LittleEndian.Uint32(footer))
+	descriptor := footer[4]
+	entrySize := int64(8)
+	if descriptor&seekTableChecksumBit != 0 {
+		entrySize = 12
+	}
+	tableSize := 8 + count*entrySize + seekTableFooterSize
+	if tableSize > size {
+		return nil, fmt.Errorf("seek table of %d frames does not fit in %d bytes", count, size)
+	}
+
+	table := make([]byte, tableSize-seekTableFooterSize)
+	if err := readFullAt(r, table, size-tableSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table) != seekTableMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:])) != tableSize-8 {
+		return nil, fmt.Errorf("seek table header is damaged")
+	}
+
+	seekTable := &SeekTable{Frames: make([]SeekTableEntry, count)}
+	var compressedOffset, decompressedOffset int64
+	for i := range seekTable.Frames {
+		entry := table[8+int64(i)*entrySize:]
+		frame := SeekTableEntry{
+			CompressedOffset:   compressedOffset,
+			CompressedSize:     int64(binary.LittleEndian.Uint32(entry)),
+			DecompressedOffset: decompressedOffset,
+			DecompressedSize:   int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		compressedOffset += frame.CompressedSize
+		decompressedOffset += frame.DecompressedSize
+		seekTable.Frames[i] = frame
+	}
+	if compressedOffset != size-tableSize {
+		return nil, fmt.Errorf("seek table covers %d bytes but frames take %d", compressedOffset, size-tableSize)
+	}
+	return seekTable, nil
+}
+
+// FrameError describes a frame that could not be decompressed.
+type FrameError struct {
+	Frame  int   // Index of the frame
+	Offset int64 // Compressed offset of the frame
+	Err    error
+}
+
+func (e FrameError) Error() string {
+	return fmt.Sprintf("frame %d at offset %d: %v", e.Frame, e.Offset, e.Err)
+}
+
+// DamagedFramesError is returned by DecompressParallel when some frames could
+// not be decompressed. Every other frame was written.
+type DamagedFramesError struct {
+	Frames []FrameError
+}
+
+func (e *DamagedFramesError) Error() string {
+	messages := make([]string, len(e.Frames))
+	for i, frame := range e.Frames {
+		messages[i] = frame.Error()
+	}
+	return fmt.Sprintf("%d damaged frames: %s", len(e.Frames), strings.Join(messages, "; "))
+}
+
+// DecompressParallel decompresses a stream of size bytes on workers goroutines,
+// one frame at a time each, writing the frames to w in order. A workers value
+// below 1 uses GOMAXPROCS.
+//
+// Frames are located with the seek table, or by scanning the stream when there
+// is none. With a seek table, a damaged frame is written as zeros of its
+// decompressed size so later frames keep their offsets, and a
+// *DamagedFramesError lists the damaged frames once the rest are written.
+func DecompressParallel(r io.ReaderAt, size int64, w io.Writer, dictionaryId string, workers int) error {
+	if dictionaryId != "" && getDictionary(dictionaryId) == nil {
+		return fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	table, err := ReadSeekTable(r, size)
+	recoverable := err == nil
+	if err == ErrNoSeekTable {
+		table, err = scanSeekTable(r, size)
+	}
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	var damaged []FrameError
+	for start := 0; start < len(table.Frames); start += workers {
+		batch := table.Frames[start:]
+		if len(batch) > workers {
+			batch = batch[:workers]
+		}
+		results := make([]result, len(batch))
+		var wg sync.WaitGroup
+		wg.Add(len(batch))
+		for i, frame := range batch {
+			go func(i int, frame SeekTableEntry) {
+				defer wg.Done()
+				results[i].data, results[i].err = decompressFrame(r, frame, dictionaryId)
+			}(i, frame)
+		}
+		wg.Wait()
+
+		for i, result := range results {
+			frame := batch[i]
+			if result.err != nil {
+				if !recoverable {
+					return FrameError{Frame: start + i, Offset: frame.CompressedOffset, Err: result.err}
+				}
+				damaged = append(damaged, FrameError{Frame: start + i, Offset: frame.CompressedOffset, Err: result.err})
+				result.data = make([]byte, frame.DecompressedSize)
+			}
+			if _, err := w.Write(result.data); err != nil {
+				return fmt.Errorf("error writing decompressed data: %v", err)
+			}
+		}
+	}
+	if len(damaged) > 0 {
+		return &DamagedFramesError{Frames: damaged}
+	}
+	return nil
+}
+
+func decompressFrame(r io.ReaderAt, frame SeekTableEntry, dictionaryId string) ([]byte, error) {
+	src := make([]byte, frame.CompressedSize)
+	if err := readFullAt(r, src, frame.CompressedOffset); err != nil {
+		return nil, err
+	}
+	var dst []byte
+	if frame.DecompressedSize > 0 {
+		dst = make([]byte, 0, frame.DecompressedSize)
+	}
+	data, err := DecompressBytes(dst, src, dictionaryId)
+	if err != nil {
+		return nil, err
+	}
+	// Sizes of scanned frames are unknown until they are decompressed
+	if frame.DecompressedSize >= 0 && int64(len(data)) != frame.DecompressedSize {
+		return nil, fmt.Errorf("decompressed to %d bytes, expected %d", len(data), frame.DecompressedSize)
+	}
+	return data, nil
+}
+
+// scanSeekTable locates zstd frames by walking their headers, for streams
+// without a seek table. Decompressed sizes are left unknown.
+func scanSeekTable(r io.ReaderAt, size int64) (*SeekTable, error) {
+	table := &SeekTable{}
+	scanner := newFrameScanner(func(frame FrameInfo) {
+		if frame.Skippable {
+			return
+		}
+		table.Frames = append(table.Frames, SeekTableEntry{
+			CompressedOffset: frame.Offset,
+			CompressedSize:   frame.Size,
+			DecompressedSize: -1,
+		})
+	})
+	if _, err := io.Copy(scanner, io.NewSectionReader(r, 0, size)); err != nil {
+		return nil, err
+	}
+	if err := scanner.finish(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// SeekableReader reads the decompressed contents of a stream with a seek table
+// at any offset, decoding only the frames a read touches. It keeps the last
+// decoded frame so sequential reads decode each frame once. ReadAt is safe for
+// concurrent use, Read and Seek are not.
+type SeekableReader struct {
+	r            io.ReaderAt
+	table        *SeekTable
+	dictionaryId string
+	position     int64
+
+	mu          sync.Mutex
+	cachedFrame int
+	cached      []byte
+}
+
+// NewSeekableReader returns a SeekableReader for a stream of size bytes compressed
+// with the dictionary dictionaryId. The stream must end in a seek table.
+func NewSeekableReader(r io.ReaderAt, size int64, dictionaryId string) (*SeekableReader, error) {
+	if dictionaryId != "" && getDictionary(dictionaryId) == nil {
+		return nil, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	table, err := ReadSeekTable(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &SeekableReader{r: r, table: table, dictionaryId: dictionaryId, cachedFrame: -1}, nil
+}
+
+// Size returns the decompressed size of the stream.
+func (s *SeekableReader) Size() int64 {
+	return s.table.DecompressedSize()
+}
+
+// SeekTable returns the seek table of the stream.
+func (s *SeekableReader) SeekTable() *SeekTable {
+	return s.table
+}
+
+// ReadAt reads decompressed bytes starting at off.
+func (s *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	frames := s.table.Frames
+	i := sort.Search(len(frames), func(i int) bool {
+		return frames[i].DecompressedOffset+frames[i].DecompressedSize > off
+	})
+	n := 0
+	for ; n < len(p) && i < len(frames); i++ {
+		data, err := s.frame(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[off+int64(n)-frames[i].DecompressedOffset:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *SeekableReader) frame(i int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cachedFrame == i {
+		return s.cached, nil
+	}
+	data, err := decompressFrame(s.r, s.table.Frames[i], s.dictionaryId)
+	if err != nil {
+		return nil, FrameError{Frame: i, Offset: s.table.Frames[i].CompressedOffset, Err: err}
+	}
+	s.cachedFrame, s.cached = i, data
+	return data, nil
+}
+
+// Read reads decompressed bytes from the current position.
+func (s *SeekableReader) Read(p []byte) (int, error) {
+	if s.position >= s.Size() {
+		return 0, io.EOF
+	}
+	n, err := s.ReadAt(p, s.position)
+	s.position += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position for the next Read in the decompressed stream.
+func (s *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.position
+	case io.SeekEnd:
+		offset += s.Size()
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	s.position = offset
+	return offset, nil
+}
@@ -0,0 +1,249 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func compressFramed(t *testing.T, body []byte, dictionaryId string, frameSize int) []byte {
+	var compressed bytes.Buffer
+	w, err := NewWriter(&compressed, dictionaryId, WithFrameSize(frameSize))
+	if err != nil {
+		t.Fatalf("Could not create writer: %v", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatalf("Could not write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Could not close writer: %v", err)
+	}
+	return compressed.Bytes()
+}
+
+func TestFrameSizeSeekTable(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	compressed := compressFramed(t, body, "supply_chain", 1000)
+
+	table, err := ReadSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatalf("Could not read seek table: %v", err)
+	}
+	expectedFrames := (len(body) + 999) / 1000
+	if len(table.Frames) != expectedFrames {
+		t.Fatalf("Expected %d frames, got %d", expectedFrames, len(table.Frames))
+	}
+	if table.DecompressedSize() != int64(len(body)) {
+		t.Errorf("Expected decompressed size %d, got %d", len(body), table.DecompressedSize())
+	}
+	if table.Frames[1].DecompressedOffset != 1000 || table.Frames[1].CompressedOffset != table.Frames[0].CompressedSize {
+		t.Errorf("Unexpected second frame: %+v", table.Frames[1])
+	}
+
+	// A plain decoder reads the frames in turn and skips the seek table
+	var out bytes.Buffer
+	if err := Decompress(bytes.NewReader(compressed), &out, "supply_chain"); err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if !bytes.Equal(body, out.Bytes()) {
+		t.Errorf("Plain round trip does not match")
+	}
+
+	out.Reset()
+	if err := DecompressParallel(bytes.NewReader(compressed), int64(len(compressed)), &out, "supply_chain", 4); err != nil {
+		t.Fatalf("Could not decompress in parallel: %v", err)
+	}
+	if !bytes.Equal(body, out.Bytes()) {
+		t.Errorf("Parallel round trip does not match")
+	}
+}
+
+func TestCompressFrameSizeConfig(t *testing.T) {
+	InitWithStruct(Config{FrameSize: IntPtr(4096)})
+	defer InitWithStruct(Config{FrameSize: IntPtr(0)})
+	body := getBody()
+
+	var compressed bytes.Buffer
+	result, err := CompressWithResult(bytes.NewReader(body), &compressed, "")
+	if err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	if expected := (len(body) + 4095) / 4096; result.Frames != expected {
+		t.Errorf("Expected %d frames, got %d", expected, result.Frames)
+	}
+	if _, err := ReadSeekTable(bytes.NewReader(compressed.Bytes()), int64(compressed.Len())); err != nil {
+		t.Errorf("Expected a seek table: %v", err)
+	}
+
+	// The seek table is a skippable frame and is not counted
+	result, err = DecompressWithResult(bytes.NewReader(compressed.Bytes()), io.Discard, "")
+	if err != nil || result.Frames != (len(body)+4095)/4096 {
+		t.Errorf("Expected the decompressed frames to match, got %d: %v", result.Frames, err)
+	}
+}
+
+func TestDecompressParallelDamagedFrame(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	compressed := compressFramed(t, body, "supply_chain", 1000)
+	table, _ := ReadSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+
+	// Damage the block contents of the second frame
+	second := table.Frames[1]
+	for i := second.CompressedOffset + 8; i < second.CompressedOffset+second.CompressedSize; i++ {
+		compressed[i] ^= 0xFF
+	}
+
+	var out bytes.Buffer
+	err := DecompressParallel(bytes.NewReader(compressed), int64(len(compressed)), &out, "supply_chain", 2)
+	var damaged *DamagedFramesError
+	if !errors.As(err, &damaged) {
+		t.Fatalf("Expected DamagedFramesError, got %v", err)
+	}
+	if len(damaged.Frames) != 1 || damaged.Frames[0].Frame != 1 {
+		t.Errorf("Expected only frame 1 damaged, got %v", damaged)
+	}
+	if out.Len() != len(body) {
+		t.Fatalf("Expected %d bytes with the damaged frame zeroed, got %d", len(body), out.Len())
+	}
+	if !bytes.Equal(out.Bytes()[:1000], body[:1000]) || !bytes.Equal(out.Bytes()[2000:], body[2000:]) {
+		t.Errorf("Intact frames were not recovered")
+	}
+	if !bytes.Equal(out.Bytes()[1000:2000], make([]byte, 1000)) {
+		t.Errorf("Expected the damaged frame to be zeroed")
+	}
+}
+
+func TestDecompressParallelWithoutSeekTable(t *testing.T) {
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader([]byte("first frame ")), &compressed, "")
+	Compress(bytes.NewReader([]byte("second frame")), &compressed, "")
+	if _, err := ReadSeekTable(bytes.NewReader(compressed.Bytes()), int64(compressed.Len())); err != ErrNoSeekTable {
+		t.Fatalf("Expected ErrNoSeekTable, got %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := DecompressParallel(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), &out, "", 0); err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if out.String() != "first frame second frame" {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
+
+// countingReaderAt counts the compressed bytes read through it.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	count int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.count += int64(n)
+	return n, err
+}
+
+// eofReaderAt returns io.EOF with reads that reach the end, as io.ReaderAt allows.
+type eofReaderAt struct {
+	*bytes.Reader
+}
+
+func (e eofReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := e.Reader.ReadAt(p, off)
+	if err == nil && off+int64(n) == e.Size() {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func TestSeekableReaderEOFWithFullRead(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	compressed := compressFramed(t, body, "supply_chain", 1000)
+	source := eofReaderAt{bytes.NewReader(compressed)}
+
+	var out bytes.Buffer
+	if err := DecompressParallel(source, int64(len(compressed)), &out, "supply_chain", 2); err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), body) {
+		t.Errorf("Unexpected output")
+	}
+	if _, err := ReadSeekTable(source, int64(len(compressed))+1); err == nil {
+		t.Errorf("Expected an error for a short read")
+	}
+}
+
+func TestSeekableReaderReadAt(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	compressed := compressFramed(t, body, "supply_chain", 1000)
+	source := &countingReaderAt{r: bytes.NewReader(compressed)}
+
+	reader, err := NewSeekableReader(source, int64(len(compressed)), "supply_chain")
+	if err != nil {
+		t.Fatalf("Could not create reader: %v", err)
+	}
+	if reader.Size() != int64(len(body)) {
+		t.Errorf("Expected size %d, got %d", len(body), reader.Size())
+	}
+
+	// A range spanning the end of frame 2 and the start of frame 3
+	source.count = 0
+	p := make([]byte, 300)
+	if _, err := reader.ReadAt(p, 2900); err != nil {
+		t.Fatalf("Could not read: %v", err)
+	}
+	if !bytes.Equal(p, body[2900:3200]) {
+		t.Errorf("Unexpected range contents")
+	}
+	table := reader.SeekTable()
+	if expected := table.Frames[2].CompressedSize + table.Frames[3].CompressedSize; source.count != expected {
+		t.Errorf("Expected to read %d compressed bytes for two frames, read %d", expected, source.count)
+	}
+
+	n, err := reader.ReadAt(p, int64(len(body))-100)
+	if n != 100 || err != io.EOF || !bytes.Equal(p[:n], body[len(body)-100:]) {
+		t.Errorf("Expected a short read of 100 bytes with EOF, got %d, %v", n, err)
+	}
+}
+
+func TestSeekableReaderSeek(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	compressed := compressFramed(t, body, "supply_chain", 1000)
+	reader, err := NewSeekableReader(bytes.NewReader(compressed), int64(len(compressed)), "supply_chain")
+	if err != nil {
+		t.Fatalf("Could not create reader: %v", err)
+	}
+
+	if _, err := reader.Seek(-500, io.SeekEnd); err != nil {
+		t.Fatalf("Could not seek: %v", err)
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(rest, body[len(body)-500:]) {
+		t.Errorf("Unexpected tail: %d bytes, %v", len(rest), err)
+	}
+
+	reader.Seek(0, io.SeekStart)
+	all, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(all, body) {
+		t.Errorf("Unexpected contents reading from the start: %v", err)
+	}
+}
+
+func TestNewSeekableReaderWithoutSeekTable(t *testing.T) {
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &compressed, "")
+	if _, err := NewSeekableReader(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), ""); err != ErrNoSeekTable {
+		t.Errorf("Expected ErrNoSeekTable, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errClosed = errors.New("towardsentropy: use of closed stream")
+
+// StreamOption configures a Writer or Reader.
+type StreamOption func(*streamOptions)
+
+type streamOptions struct {
+	level      int
+	bufferSize int
+	workers    int
+	frameSize  int
+}
+
+// WithEncoderLevel sets the compression level of a Writer, overriding CompressionLevel.
+func WithEncoderLevel(level int) StreamOption {
+	return func(o *streamOptions) { o.level = level }
+}
+
+// WithBufferSize sets the size of the buffer used by ReadFrom and WriteTo,
+// overriding BufferSize. Sizes below 1 leave BufferSize in place.
+func WithBufferSize(size int) StreamOption {
+	return func(o *streamOptions) { o.bufferSize = size }
+}
+
+// WithWorkers sets the number of threads a Writer compresses with, overriding CompressionWorkers.
+func WithWorkers(workers int) StreamOption {
+	return func(o *streamOptions) { o.workers = workers }
+}
+
+// WithFrameSize has a Writer start a new frame every size bytes and end with a
+// seek table, overriding FrameSize.
+func WithFrameSize(size int) StreamOption {
+	return func(o *streamOptions) { o.frameSize = size }
+}
+
+func newStreamOptions(opts []StreamOption) streamOptions {
+	config := getConfig()
+	o := streamOptions{
+		level:      config.CompressionLevel,
+		bufferSize: config.BufferSize,
+		workers:    config.CompressionWorkers,
+		frameSize:  config.FrameSize,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.bufferSize <= 0 {
+		// An empty buffer would never make progress in ReadFrom and WriteTo
+		o.bufferSize = config.BufferSize
+	}
+	return o
+}
+
+func streamDictionary(dictionaryId string) (*Dictionary, error) {
+	dictionary := getDictionary(dictionaryId)
+	if dictionary == nil && dictionaryId != "" {
+		return nil, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	return dictionary, nil
+}
+
+// switchWriter lets a Writer point its zstd stream somewhere else, so Reset can
+// drop a stream without writing its epilogue to the old destination.
+type switchWriter struct {
+	io.Writer
+}
+
+// Writer is an io.WriteCloser compressing what is written to it with a dictionary.
+// Close finishes the stream but does not close the underlying writer.
+type Writer struct {
+	dst        *switchWriter
+	zw         encoder
+	dictionary *Dictionary
+	opts       streamOptions
+	closed     bool
+}
+
+// NewWriter returns a Writer compressing to w with the dictionary dictionaryId,
+// or plain zstd when dictionaryId is "".
+func NewWriter(w io.Writer, dictionaryId string, opts ...StreamOption) (*Writer, error) {
+	dictionary, err := streamDictionary(dictionaryId)
+	if err != nil {
+		return nil, err
+	}
+	zw := &Writer{dictionary: dictionary, opts: newStreamOptions(opts)}
+	if err := zw.open(w); err != nil {
+		return nil, err
+	}
+	return zw, nil
+}
+
+func (w *Writer) open(dst io.Writer) error {
+	w.dst = &switchWriter{Writer: dst}
+	zw, err := newEncoder(w.dst, w.dictionary, w.opts.level, w.opts.workers, w.opts.frameSize)
+	if err != nil {
+		return err
+	}
+	w.zw = zw
+	w.closed = false
+	return nil
+}
+
+// Write compresses p. Data may be buffered until Flush or Close.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	return w.zw.Write(p)
+}
+
+// Flush writes out any buffered data so everything written so far can be decompressed.
+func (w *Writer) Flush() error {
+	if w.closed {
+		return errClosed
+	}
+	return w.zw.Flush()
+}
+
+// Close finishes the frame, writes any seek table and releases the encoder. It is safe to call more than once.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.zw.Close()
+}
+
+// Reset discards any unfinished stream and starts a new one writing to dst,
+// keeping the dictionary and options.
+func (w *Writer) Reset(dst io.Writer) {
+	if !w.closed {
+		w.dst.Writer = io.Discard
+		w.zw.Close()
+	}
+	// The options were accepted when the Writer was created, so this cannot fail now
+	w.open(dst)
+}
+
+// ReadFrom compresses everything read from r until EOF, handing the copy to r
+// when it implements io.WriterTo.
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.closed {
+		return 0, errClosed
+	}
+	if wt, ok := r.(io.WriterTo); ok {
+		return wt.WriteTo(w.zw)
+	}
+	buf := make([]byte, w.opts.bufferSize)
+	var total int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.zw.Write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Reader is an io.ReadCloser decompressing a stream compressed with a dictionary.
+// Close releases the decoder but does not close the underlying reader.
+type Reader struct {
+	zr         io.ReadCloser
+	dictionary *Dictionary
+	opts       streamOptions
+	closed     bool
+}
+
+// NewReader returns a Reader decompressing r with the dictionary dictionaryId,
+// or plain zstd when dictionaryId is "".
+func NewReader(r io.Reader, dictionaryId string, opts ...StreamOption) (*Reader, error) {
+	dictionary, err := streamDictionary(dictionaryId)
+	if err != nil {
+		return nil, err
+	}
+	zr := &Reader{dictionary: dictionary, opts: newStreamOptions(opts)}
+	zr.open(r)
+	return zr, nil
+}
+
+func (r *Reader) open(src io.Reader) {
+	r.zr = newDecoder(src, r.dictionary)
+	r.closed = false
+}
+
+// Read reads decompressed data into p.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errClosed
+	}
+	return r.zr.Read(p)
+}
+
+// Close releases the decoder. It is safe to call more than once.
+func (r *Reader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	return r.zr.Close()
+}
+
+// Reset discards any unfinished stream and starts decompressing src, keeping
+// the dictionary and options.
+func (r *Reader) Reset(src io.Reader) {
+	r.Close()
+	r.open(src)
+}
+
+// WriteTo writes the decompressed stream to w until EOF, handing the copy to w
+// when it implements io.ReaderFrom.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if r.closed {
+		return 0, errClosed
+	}
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r.zr)
+	}
+	buf := make([]byte, r.opts.bufferSize)
+	var total int64
+	for {
+		n, err := r.zr.Read(buf)
+		if n > 0 {
+			written, werr := w.Write(buf[:n])
+			total += int64(written)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriterReaderJSON(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	value := map[string]string{"name": "supply chain", "kind": "dictionary"}
+
+	var compressed bytes.Buffer
+	w, err := NewWriter(&compressed, "supply_chain", WithEncoderLevel(10))
+	if err != nil {
+		t.Fatalf("Could not create writer: %v", err)
+	}
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		t.Fatalf("Could not encode: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Could not close writer: %v", err)
+	}
+	if _, err := w.Write([]byte("late")); err != errClosed {
+		t.Errorf("Expected errClosed after Close, got %v", err)
+	}
+
+	r, err := NewReader(&compressed, "supply_chain")
+	if err != nil {
+		t.Fatalf("Could not create reader: %v", err)
+	}
+	defer r.Close()
+	var decoded map[string]string
+	if err := json.NewDecoder(r).Decode(&decoded); err != nil {
+		t.Fatalf("Could not decode: %v", err)
+	}
+	if decoded["name"] != "supply chain" || decoded["kind"] != "dictionary" {
+		t.Errorf("Unexpected value: %v", decoded)
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	var compressed bytes.Buffer
+	w, err := NewWriter(&compressed, "")
+	if err != nil {
+		t.Fatalf("Could not create writer: %v", err)
+	}
+	defer w.Close()
+	w.Write([]byte("first"))
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Could not flush: %v", err)
+	}
+
+	// Everything written before the flush is readable without closing the writer
+	r, _ := NewReader(bytes.NewReader(compressed.Bytes()), "")
+	defer r.Close()
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "first" {
+		t.Errorf("Expected first, got %q (%v)", buf, err)
+	}
+}
+
+func TestWriterReaderReset(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	var first, second bytes.Buffer
+	w, err := NewWriter(&first, "enwik8")
+	if err != nil {
+		t.Fatalf("Could not create writer: %v", err)
+	}
+	w.Write([]byte("abandoned"))
+	w.Reset(&second)
+	w.Write([]byte("kept"))
+	w.Close()
+	if first.Len() != 0 {
+		t.Errorf("Expected nothing written to the abandoned destination, got %d bytes", first.Len())
+	}
+
+	r, err := NewReader(strings.NewReader("not zstd"), "enwik8")
+	if err != nil {
+		t.Fatalf("Could not create reader: %v", err)
+	}
+	r.Reset(&second)
+	var out bytes.Buffer
+	if _, err := r.WriteTo(&out); err != nil {
+		t.Fatalf("Could not read after reset: %v", err)
+	}
+	r.Close()
+	if out.String() != "kept" {
+		t.Errorf("Expected kept, got %q", out.String())
+	}
+}
+
+func TestWriterReadFromReaderWriteTo(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+
+	var compressed bytes.Buffer
+	w, _ := NewWriter(&compressed, "supply_chain", WithBufferSize(7))
+	// Hide bytes.Reader's WriteTo so the buffered path runs too
+	n, err := w.ReadFrom(struct{ io.Reader }{bytes.NewReader(body)})
+	if err != nil || n != int64(len(body)) {
+		t.Fatalf("ReadFrom returned %d, %v", n, err)
+	}
+	w.Close()
+
+	r, _ := NewReader(&compressed, "supply_chain", WithBufferSize(7))
+	defer r.Close()
+	var out countingWriter
+	out.Writer = io.Discard
+	n, err = r.WriteTo(&out)
+	if err != nil || n != int64(len(body)) || out.count != int64(len(body)) {
+		t.Fatalf("WriteTo returned %d, %v", n, err)
+	}
+}
+
+func TestNewWriterMissingDictionary(t *testing.T) {
+	if _, err := NewWriter(io.Discard, "missing"); err == nil {
+		t.Errorf("Expected error for missing dictionary")
+	}
+	if _, err := NewReader(strings.NewReader(""), "missing"); err == nil {
+		t.Errorf("Expected error for missing dictionary")
+	}
+}
+
+func TestWriterWithWorkers(t *testing.T) {
+	body := bytes.Repeat(getBody(), 20)
+	var compressed bytes.Buffer
+	w, err := NewWriter(&compressed, "", WithWorkers(2))
+	if err != nil {
+		t.Fatalf("Could not create writer: %v", err)
+	}
+	w.Write(body)
+	w.Close()
+
+	var out bytes.Buffer
+	if err := Decompress(&compressed, &out, ""); err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if !bytes.Equal(body, out.Bytes()) {
+		t.Errorf("Round trip does not match")
+	}
+}
+
+func TestWithBufferSizeInvalid(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	body := getBody()
+	for _, size := range []int{0, -1} {
+		var compressed bytes.Buffer
+		w, _ := NewWriter(&compressed, "supply_chain", WithBufferSize(size))
+		if n, err := w.ReadFrom(struct{ io.Reader }{bytes.NewReader(body)}); err != nil || n != int64(len(body)) {
+			t.Fatalf("ReadFrom with buffer size %d returned %d, %v", size, n, err)
+		}
+		w.Close()
+
+		r, _ := NewReader(&compressed, "supply_chain", WithBufferSize(size))
+		var out bytes.Buffer
+		if _, err := r.WriteTo(struct{ io.Writer }{&out}); err != nil || !bytes.Equal(out.Bytes(), body) {
+			t.Errorf("WriteTo with buffer size %d failed: %v", size, err)
+		}
+		r.Close()
+	}
+}
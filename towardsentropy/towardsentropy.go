@@ -8,87 +8,193 @@ package towardsentropy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/DataDog/zstd"
 )
 
+// CompressionResult describes a completed compression or decompression.
+type CompressionResult struct {
+	BytesRead      int64         // Bytes read from the source
+	BytesWritten   int64         // Bytes written to the destination
+	Elapsed        time.Duration // Time taken
+	DictionaryId   string        // Dictionary used, "" for plain zstd
+	DictionaryHash string        // Hex encoded SHA-256 of the dictionary, "" for plain zstd
+	Level          int           // Compression level, 0 when decompressing
+	Frames         int           // Number of zstd frames written or read
+}
+
 func Compress(r io.Reader, w io.Writer, dictionaryId string) error {
+	_, err := compressWithResult(context.Background(), r, w, dictionaryId)
+	return err
+}
+
+// CompressContext is Compress, stopping with ctx.Err() between reads once ctx is done.
+func CompressContext(ctx context.Context, r io.Reader, w io.Writer, dictionaryId string) error {
+	_, err := compressWithResult(ctx, r, w, dictionaryId)
+	return err
+}
+
+// CompressWithResult is Compress, also reporting what the compression did.
+func CompressWithResult(r io.Reader, w io.Writer, dictionaryId string) (CompressionResult, error) {
+	return compressWithResult(context.Background(), r, w, dictionaryId)
+}
+
+func compressWithResult(ctx context.Context, r io.Reader, w io.Writer, dictionaryId string) (CompressionResult, error) {
 	config := getConfig()
+	result := CompressionResult{DictionaryId: dictionaryId, Level: config.CompressionLevel}
 	dictionary := getDictionary(dictionaryId)
 	if dictionary == nil && dictionaryId != "" {
-		return fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+		defaultMetrics.recordError(sourceDirect, "compress")
+		return result, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	if dictionary != nil {
+		result.DictionaryHash = dictionary.Hash()
+	}
+
+	start := time.Now()
+	in := &countingReadCloser{ReadCloser: io.NopCloser(r)}
+	out := &countingWriter{Writer: w}
+	frames, err := compress(ctx, in, out, dictionary, config)
+	result.BytesRead = in.count
+	result.BytesWritten = out.count
+	result.Elapsed = time.Since(start)
+	result.Frames = frames
+	if err != nil {
+		defaultMetrics.recordError(sourceDirect, "compress")
+		return result, err
 	}
+	defaultMetrics.recordCompress(sourceDirect, dictionaryId, result.BytesRead, result.BytesWritten, result.Elapsed)
+	return result, nil
+}
 
-	var zw *zstd.Writer
-	if dictionary == nil {
-		zw = zstd.NewWriterLevel(w, config.CompressionLevel)
-	} else {
-		zw = zstd.NewWriterLevelDict(w, config.CompressionLevel, dictionary.Bytes)
+func compress(ctx context.Context, r io.Reader, w io.Writer, dictionary *Dictionary, config internalConfig) (int, error) {
+	zw, err := newEncoder(w, dictionary, config.CompressionLevel, config.CompressionWorkers, config.FrameSize)
+	if err != nil {
+		return 0, err
 	}
-	defer zw.Close()
+	closed := false
+	defer func() {
+		if !closed {
+			zw.Close()
+		}
+	}()
 
 	buf := make([]byte, config.BufferSize)
 	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		// A reader may return its last bytes along with io.EOF
 		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := zw.Write(buf[:n]); err != nil {
+				return 0, fmt.Errorf("error compressing and writing data: %v", err)
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("error reading response body: %v", err)
-		}
-
-		_, err = zw.Write(buf[:n])
-		if err != nil {
-			return fmt.Errorf("error compressing and writing data: %v", err)
+			return 0, fmt.Errorf("error reading response body: %v", err)
 		}
 	}
 
-	// Flush any unwritten data to the underlying writer
-	err := zw.Flush()
-	if err != nil {
-		return fmt.Errorf("error flushing remaining data: %v", err)
+	// Finish the frame and write any unwritten data to the underlying writer
+	closed = true
+	if err := zw.Close(); err != nil {
+		return 0, fmt.Errorf("error flushing remaining data: %v", err)
 	}
 
+	return encodedFrames(zw), nil
+}
+
+// setWorkers has zstd compress with workers threads. Frames are still plain
+// zstd frames, any decoder reads them.
+func setWorkers(zw *zstd.Writer, workers int) error {
+	if workers <= 1 {
+		return nil
+	}
+	if err := zw.SetNbWorkers(workers); err != nil {
+		return fmt.Errorf("could not compress with %d workers: %v", workers, err)
+	}
 	return nil
 }
 
 func Decompress(r io.Reader, w io.Writer, dictionaryId string) error {
+	_, err := decompressWithResult(context.Background(), r, w, dictionaryId)
+	return err
+}
+
+// DecompressContext is Decompress, stopping with ctx.Err() between reads once ctx is done.
+func DecompressContext(ctx context.Context, r io.Reader, w io.Writer, dictionaryId string) error {
+	_, err := decompressWithResult(ctx, r, w, dictionaryId)
+	return err
+}
+
+// DecompressWithResult is Decompress, also reporting what the decompression did.
+func DecompressWithResult(r io.Reader, w io.Writer, dictionaryId string) (CompressionResult, error) {
+	return decompressWithResult(context.Background(), r, w, dictionaryId)
+}
+
+func decompressWithResult(ctx context.Context, r io.Reader, w io.Writer, dictionaryId string) (CompressionResult, error) {
 	config := getConfig()
+	result := CompressionResult{DictionaryId: dictionaryId}
 	dictionary := getDictionary(dictionaryId)
-
 	if dictionary == nil && dictionaryId != "" {
-		return fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+		defaultMetrics.recordError(sourceDirect, "decompress")
+		return result, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+	}
+	if dictionary != nil {
+		result.DictionaryHash = dictionary.Hash()
 	}
 
-	var zr io.ReadCloser
-	if dictionary == nil {
-		zr = zstd.NewReader(r)
-	} else {
-		zr = zstd.NewReaderDict(r, dictionary.Bytes)
+	start := time.Now()
+	in := &countingReadCloser{ReadCloser: io.NopCloser(r)}
+	out := &countingWriter{Writer: w}
+	frames, err := decompress(ctx, in, out, dictionary, config)
+	result.BytesRead = in.count
+	result.BytesWritten = out.count
+	result.Elapsed = time.Since(start)
+	result.Frames = frames
+	if err != nil {
+		defaultMetrics.recordError(sourceDirect, "decompress")
+		return result, err
 	}
+	defaultMetrics.recordDecompress(sourceDirect, dictionaryId, result.BytesRead, result.BytesWritten, result.Elapsed)
+	return result, nil
+}
+
+func decompress(ctx context.Context, r io.Reader, w io.Writer, dictionary *Dictionary, config internalConfig) (int, error) {
+	bounded := newFrameBoundedReader(r)
+	zr := newBoundedDecoder(bounded, dictionary)
 	defer zr.Close()
 
 	// TODO buffer size from config
 	buf := make([]byte, config.BufferSize)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return bounded.frames, err
+		}
 		n, err := zr.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return bounded.frames, fmt.Errorf("error writing decompressed data: %v", err)
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("error reading from compressed source: %v", err)
-		}
-
-		_, err = w.Write(buf[:n])
-		if err != nil {
-			return fmt.Errorf("error writing decompressed data: %v", err)
+			return bounded.frames, fmt.Errorf("error reading from compressed source: %v", err)
 		}
 	}
 
-	return nil
+	return bounded.frames, nil
 }
 
 func CompressFile(b []byte, w io.Writer, dictionaryId string) error {
@@ -8,8 +8,13 @@ package towardsentropy
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestCompressDecompress(t *testing.T) {
@@ -95,3 +100,139 @@ func TestInvalidDecompress(t *testing.T) {
 		t.Fatalf("Expected error when trying to decompress invalid data, got nil.")
 	}
 }
+
+func TestCompressDecompressWithResult(t *testing.T) {
+	InitWithStruct(Config{CompressionLevel: IntPtr(3)})
+	updateCacheFromDir("../testdata/dictionaries")
+	data := getBody()
+	var compressed bytes.Buffer
+
+	result, err := CompressWithResult(bytes.NewReader(data), &compressed, "supply_chain")
+	InitWithStruct(Config{CompressionLevel: IntPtr(5)})
+	if err != nil {
+		t.Fatalf("Failed to compress data: %v", err)
+	}
+	dictionary := getDictionary("supply_chain")
+	if result.BytesRead != int64(len(data)) || result.BytesWritten != int64(compressed.Len()) {
+		t.Errorf("Unexpected byte counts: %+v", result)
+	}
+	if result.DictionaryId != "supply_chain" || result.DictionaryHash != dictionary.Hash() || len(result.DictionaryHash) != 64 {
+		t.Errorf("Unexpected dictionary: %+v", result)
+	}
+	if result.Level != 3 || result.Frames != 1 || result.Elapsed <= 0 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	compressedLength := int64(compressed.Len())
+	var decompressed bytes.Buffer
+	result, err = DecompressWithResult(&compressed, &decompressed, "supply_chain")
+	if err != nil {
+		t.Fatalf("Failed to decompress data: %v", err)
+	}
+	if result.BytesRead != compressedLength || result.BytesWritten != int64(len(data)) {
+		t.Errorf("Unexpected byte counts: %+v", result)
+	}
+	if result.Level != 0 || result.Frames != 1 || result.DictionaryHash != dictionary.Hash() {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+}
+
+// cancelingReader cancels its context after the first read.
+type cancelingReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	c.cancel()
+	return n, err
+}
+
+func TestCompressDecompressContext(t *testing.T) {
+	InitWithStruct(Config{BufferSize: IntPtr(1024)})
+	data := getBody()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &cancelingReader{Reader: bytes.NewReader(data), cancel: cancel}
+	var compressed bytes.Buffer
+	err := CompressContext(ctx, reader, &compressed, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled compressing, got %v", err)
+	}
+
+	compressed.Reset()
+	if err := CompressContext(context.Background(), bytes.NewReader(data), &compressed, ""); err != nil {
+		t.Fatalf("Failed to compress data: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	reader = &cancelingReader{Reader: &compressed, cancel: cancel}
+	var decompressed bytes.Buffer
+	err = DecompressContext(ctx, reader, &decompressed, "")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled decompressing, got %v", err)
+	}
+	if decompressed.Len() >= len(data) {
+		t.Errorf("Expected decompression to stop early, got %d bytes", decompressed.Len())
+	}
+}
+
+func TestCompressDecompressDataWithEOF(t *testing.T) {
+	body := getBody()
+	var compressed, out bytes.Buffer
+	// DataErrReader returns the last bytes together with io.EOF, as HTTP bodies do
+	if err := Compress(iotest.DataErrReader(bytes.NewReader(body)), &compressed, ""); err != nil {
+		t.Fatalf("Could not compress: %v", err)
+	}
+	if err := Decompress(iotest.DataErrReader(&compressed), &out, ""); err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), body) {
+		t.Errorf("Expected %d bytes back, got %d", len(body), out.Len())
+	}
+}
+
+func TestCompressWithWorkers(t *testing.T) {
+	updateCacheFromDir("../testdata/dictionaries")
+	data, err := os.ReadFile("../testdata/files/enwik/enwik_first_2048kb")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	InitWithStruct(Config{CompressionWorkers: IntPtr(4)})
+	defer InitWithStruct(Config{CompressionWorkers: IntPtr(1)})
+
+	var compressed bytes.Buffer
+	if err := Compress(bytes.NewReader(data), &compressed, "enwik8"); err != nil {
+		t.Fatalf("Could not compress with workers: %v", err)
+	}
+	var decompressed bytes.Buffer
+	if err := Decompress(&compressed, &decompressed, "enwik8"); err != nil {
+		t.Fatalf("Could not decompress: %v", err)
+	}
+	if !bytes.Equal(data, decompressed.Bytes()) {
+		t.Errorf("Round trip does not match")
+	}
+}
+
+func benchmarkCompressWorkers(b *testing.B, workers int) {
+	updateCacheFromDir("../testdata/dictionaries")
+	data, err := os.ReadFile("../testdata/files/enwik/enwik_first_2048kb")
+	if err != nil {
+		b.Fatalf("Could not read file: %v", err)
+	}
+	// zstd hands each worker jobs of several window sizes, repeat the file so there are enough jobs
+	data = bytes.Repeat(data, 8)
+	InitWithStruct(Config{CompressionWorkers: IntPtr(workers), BufferSize: IntPtr(64 * 1024)})
+	defer InitWithStruct(Config{CompressionWorkers: IntPtr(1), BufferSize: IntPtr(1024)})
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := Compress(bytes.NewReader(data), io.Discard, "enwik8"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompressWorkers1(b *testing.B) { benchmarkCompressWorkers(b, 1) }
+func BenchmarkCompressWorkers4(b *testing.B) { benchmarkCompressWorkers(b, 4) }
@@ -0,0 +1,157 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"context"
+	"time"
+)
+
+// CompressionTrace is a set of hooks run at stages of dictionary negotiation and
+// compression. TowardsEntropyTransport runs them from RoundTrip and
+// TowardsEntropyHandler from ServeHTTP. Any hook may be nil.
+type CompressionTrace struct {
+	// OnDictionarySelected is called once the encoding of a body is settled.
+	OnDictionarySelected func(DictionarySelectedInfo)
+
+	// OnPreflightStart is called before the transport sends a preflight HEAD request.
+	OnPreflightStart func(PreflightStartInfo)
+
+	// OnPreflightDone is called when the preflight HEAD request completes.
+	OnPreflightDone func(PreflightDoneInfo)
+
+	// OnCompressStart is called before a body is compressed.
+	OnCompressStart func(CompressStartInfo)
+
+	// OnCompressDone is called after a body has been compressed.
+	OnCompressDone func(CompressDoneInfo)
+
+	// OnDecompressStart is called before a body is decompressed.
+	OnDecompressStart func(DecompressStartInfo)
+
+	// OnDecompressDone is called once a compressed body has been read to the end.
+	OnDecompressDone func(DecompressDoneInfo)
+
+	// OnDecompressError is called when reading a compressed body fails.
+	OnDecompressError func(DecompressErrorInfo)
+}
+
+// DictionarySelectedInfo is passed to CompressionTrace.OnDictionarySelected.
+type DictionarySelectedInfo struct {
+	Encoding     CompressionType // Encoding of the body
+	DictionaryId string          // Dictionary the body is encoded with, "" for plain zstd
+	Explanation  *Explanation    // How the handler picked the dictionary, nil in the transport
+}
+
+// PreflightStartInfo is passed to CompressionTrace.OnPreflightStart.
+type PreflightStartInfo struct {
+	URL string
+}
+
+// PreflightDoneInfo is passed to CompressionTrace.OnPreflightDone.
+type PreflightDoneInfo struct {
+	DictionaryId string // Dictionary offered by the server, "" when none
+	Err          error
+}
+
+// CompressStartInfo is passed to CompressionTrace.OnCompressStart.
+type CompressStartInfo struct {
+	Encoding     CompressionType
+	DictionaryId string
+	Level        int
+}
+
+// CompressDoneInfo is passed to CompressionTrace.OnCompressDone.
+type CompressDoneInfo struct {
+	Encoding     CompressionType
+	DictionaryId string
+	BytesIn      int64 // Uncompressed bytes
+	BytesOut     int64 // Compressed bytes
+	Elapsed      time.Duration
+	Err          error
+}
+
+// DecompressStartInfo is passed to CompressionTrace.OnDecompressStart.
+type DecompressStartInfo struct {
+	Encoding     CompressionType
+	DictionaryId string
+}
+
+// DecompressDoneInfo is passed to CompressionTrace.OnDecompressDone.
+type DecompressDoneInfo struct {
+	Encoding     CompressionType
+	DictionaryId string
+	BytesIn      int64 // Compressed bytes
+	BytesOut     int64 // Decompressed bytes
+	Elapsed      time.Duration
+}
+
+// DecompressErrorInfo is passed to CompressionTrace.OnDecompressError.
+type DecompressErrorInfo struct {
+	Encoding     CompressionType
+	DictionaryId string
+	Err          error
+}
+
+// WithCompressionTrace returns a context whose requests run the hooks in trace.
+func WithCompressionTrace(ctx context.Context, trace *CompressionTrace) context.Context {
+	return context.WithValue(ctx, compressionTraceContextKey, trace)
+}
+
+// ContextCompressionTrace returns the CompressionTrace set on ctx, or nil.
+func ContextCompressionTrace(ctx context.Context) *CompressionTrace {
+	trace, _ := ctx.Value(compressionTraceContextKey).(*CompressionTrace)
+	return trace
+}
+
+func (t *CompressionTrace) dictionarySelected(info DictionarySelectedInfo) {
+	if t != nil && t.OnDictionarySelected != nil {
+		t.OnDictionarySelected(info)
+	}
+}
+
+func (t *CompressionTrace) preflightStart(info PreflightStartInfo) {
+	if t != nil && t.OnPreflightStart != nil {
+		t.OnPreflightStart(info)
+	}
+}
+
+func (t *CompressionTrace) preflightDone(info PreflightDoneInfo) {
+	if t != nil && t.OnPreflightDone != nil {
+		t.OnPreflightDone(info)
+	}
+}
+
+func (t *CompressionTrace) compressStart(info CompressStartInfo) {
+	if t != nil && t.OnCompressStart != nil {
+		t.OnCompressStart(info)
+	}
+}
+
+func (t *CompressionTrace) compressDone(info CompressDoneInfo) {
+	if t != nil && t.OnCompressDone != nil {
+		t.OnCompressDone(info)
+	}
+}
+
+func (t *CompressionTrace) decompressStart(info DecompressStartInfo) {
+	if t != nil && t.OnDecompressStart != nil {
+		t.OnDecompressStart(info)
+	}
+}
+
+func (t *CompressionTrace) decompressDone(info DecompressDoneInfo) {
+	if t != nil && t.OnDecompressDone != nil {
+		t.OnDecompressDone(info)
+	}
+}
+
+func (t *CompressionTrace) decompressError(info DecompressErrorInfo) {
+	if t != nil && t.OnDecompressError != nil {
+		t.OnDecompressError(info)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func newRecordingTrace(events *[]string) *CompressionTrace {
+	return &CompressionTrace{
+		OnDictionarySelected: func(info DictionarySelectedInfo) {
+			*events = append(*events, "selected:"+info.DictionaryId)
+		},
+		OnPreflightStart: func(info PreflightStartInfo) { *events = append(*events, "preflight-start") },
+		OnPreflightDone: func(info PreflightDoneInfo) {
+			*events = append(*events, "preflight-done:"+info.DictionaryId)
+		},
+		OnCompressStart: func(info CompressStartInfo) { *events = append(*events, "compress-start") },
+		OnCompressDone: func(info CompressDoneInfo) {
+			if info.Err == nil && info.BytesIn > 0 && info.BytesOut > 0 {
+				*events = append(*events, "compress-done")
+			}
+		},
+		OnDecompressStart: func(info DecompressStartInfo) { *events = append(*events, "decompress-start") },
+		OnDecompressDone: func(info DecompressDoneInfo) {
+			if info.BytesIn > 0 && info.BytesOut > 0 {
+				*events = append(*events, "decompress-done")
+			}
+		},
+		OnDecompressError: func(info DecompressErrorInfo) { *events = append(*events, "decompress-error") },
+	}
+}
+
+func TestTransportTrace(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		PreflightWrites:     BoolPtr(true),
+	})
+	base := &MockRoundTripper{
+		expectedBody: nil,
+		preflightResponse: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Dictionary-Id": []string{"supply_chain"}},
+		},
+	}
+	transport := NewTowardsEntropyTransport(base)
+
+	body := getBody()
+	var compressed bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &compressed, "supply_chain"); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+	base.expectedBody = compressed.Bytes()
+
+	var events []string
+	ctx := WithCompressionTrace(context.Background(), newRecordingTrace(&events))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+	if _, err := transport.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+
+	expected := []string{"preflight-start", "preflight-done:supply_chain", "selected:supply_chain", "compress-start", "compress-done"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("Unexpected trace events: got %v, expected %v", events, expected)
+	}
+}
+
+func TestHandlerTrace(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ := io.ReadAll(r.Body)
+		w.Write(received)
+	}))
+
+	testCases := []struct {
+		name     string
+		body     []byte
+		expected []string
+	}{
+		// Compressing starts when the wrapped handler writes its response
+		{"valid", nil, []string{"decompress-start", "selected:supply_chain", "decompress-done", "compress-start", "compress-done"}},
+		{"corrupt", []byte("not zstd"), []string{"decompress-start", "selected:supply_chain", "decompress-error", "compress-start"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := tc.body
+			if body == nil {
+				var compressed bytes.Buffer
+				if err := Compress(bytes.NewReader(getBody()), &compressed, "supply_chain"); err != nil {
+					t.Fatalf("Could not compress body: %v", err)
+				}
+				body = compressed.Bytes()
+			}
+
+			var events []string
+			ctx := WithCompressionTrace(context.Background(), newRecordingTrace(&events))
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/upload", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Could not create HTTP request: %v", err)
+			}
+			req.Header.Set("Content-Encoding", string(SharedZstd))
+			req.Header.Set("Dictionary-Id", "supply_chain")
+			req.Header.Add("Accept-Encoding", string(SharedZstd))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !reflect.DeepEqual(events, tc.expected) {
+				t.Errorf("Unexpected trace events: got %v, expected %v", events, tc.expected)
+			}
+		})
+	}
+}
+
+func TestHandlerTraceNotCompressed(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	testCases := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{"not modified", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotModified) }},
+		{"partial", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-1/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("01"))
+		}},
+		{"encoded", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte("encoded"))
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var events []string
+			ctx := WithCompressionTrace(context.Background(), newRecordingTrace(&events))
+			req := httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx)
+			req.Header.Set("Accept-Encoding", "szstd")
+			req.Header.Set("Available-Dictionary", "supply_chain")
+			NewTowardsEntropyHandler(tc.handler).ServeHTTP(httptest.NewRecorder(), req)
+
+			if expected := []string{"selected:supply_chain"}; !reflect.DeepEqual(events, expected) {
+				t.Errorf("Unexpected trace events: got %v, expected %v", events, expected)
+			}
+		})
+	}
+
+	var level int
+	ctx := WithCompressionTrace(context.Background(), &CompressionTrace{
+		OnCompressStart: func(info CompressStartInfo) { level = info.Level },
+	})
+	req := httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "zstd")
+	NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	if level != responseLevel {
+		t.Errorf("Expected level %d, got %d", responseLevel, level)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import "fmt"
+
+// DefaultDictionarySize is the dictionary size zstd --train uses.
+const DefaultDictionarySize = 112640
+
+// TrainOption configures TrainDictionary.
+type TrainOption func(*trainOptions)
+
+type trainOptions struct {
+	level   int
+	zstdId  uint32
+	threads int
+}
+
+// WithTrainingLevel tunes a dictionary for a compression level, 0 for the zstd default.
+func WithTrainingLevel(level int) TrainOption {
+	return func(o *trainOptions) { o.level = level }
+}
+
+// WithZstdId sets the id zstd writes into the dictionary and the frames
+// compressed with it. By default it is derived from the dictionary contents.
+func WithZstdId(id uint32) TrainOption {
+	return func(o *trainOptions) { o.zstdId = id }
+}
+
+// WithTrainingThreads sets the number of threads used to search for training parameters.
+func WithTrainingThreads(threads int) TrainOption {
+	return func(o *trainOptions) { o.threads = threads }
+}
+
+// TrainDictionary trains a dictionary of at most size bytes from samples, the
+// way zstd --train does. The result can be saved as a .dict file in
+// DictionaryDirectory. Training needs many samples, each much smaller than the
+// dictionary; split large files with SplitSamples.
+func TrainDictionary(samples [][]byte, size int, opts ...TrainOption) ([]byte, error) {
+	o := trainOptions{threads: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid dictionary size %d", size)
+	}
+
+	nonEmpty := make([][]byte, 0, len(samples))
+	total := 0
+	for _, sample := range samples {
+		if len(sample) > 0 {
+			nonEmpty = append(nonEmpty, sample)
+			total += len(sample)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return nil, fmt.Errorf("no samples to train on")
+	}
+	buf := make([]byte, 0, total)
+	sizes := make([]int, len(nonEmpty))
+	for i, sample := range nonEmpty {
+		buf = append(buf, sample...)
+		sizes[i] = len(sample)
+	}
+
+	dictionary := make([]byte, size)
+	n, err := trainFastCover(dictionary, buf, sizes, o)
+	if err != nil {
+		return nil, fmt.Errorf("could not train dictionary from %d samples: %v", len(sizes), err)
+	}
+	return dictionary[:n], nil
+}
+
+// SplitSamples cuts data into samples of blockSize bytes, the last one possibly
+// shorter, like the -B option of zstd --train.
+func SplitSamples(data []byte, blockSize int) [][]byte {
+	if blockSize <= 0 {
+		return [][]byte{data}
+	}
+	samples := make([][]byte, 0, len(data)/blockSize+1)
+	for len(data) > blockSize {
+		samples = append(samples, data[:blockSize:blockSize])
+		data = data[blockSize:]
+	}
+	if len(data) > 0 {
+		samples = append(samples, data)
+	}
+	return samples
+}
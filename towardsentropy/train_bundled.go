@@ -0,0 +1,90 @@
+//go:build !external_libzstd
+
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+// The ZDICT functions come from the C zstd bundled with github.com/DataDog/zstd,
+// which links them into every binary using this package. The bundle does not
+// expose zdict.h to importers, so the parameter structs are copied from the
+// zdict.h of zstd 1.5.5 and their layout is checked against it on 64 bit
+// platforms. Builds with the external_libzstd tag include the system zdict.h.
+
+/*
+#include <stddef.h>
+#include <stdint.h>
+
+typedef struct {
+	int      compressionLevel;
+	unsigned notificationLevel;
+	unsigned dictID;
+} ZDICT_params_t;
+
+typedef struct {
+	unsigned k;
+	unsigned d;
+	unsigned f;
+	unsigned steps;
+	unsigned nbThreads;
+	double splitPoint;
+	unsigned accel;
+	unsigned shrinkDict;
+	unsigned shrinkDictMaxRegression;
+	ZDICT_params_t zParams;
+} ZDICT_fastCover_params_t;
+
+#if UINTPTR_MAX == UINT64_MAX
+_Static_assert(sizeof(ZDICT_params_t) == 12, "ZDICT_params_t does not match zdict.h");
+_Static_assert(offsetof(ZDICT_fastCover_params_t, splitPoint) == 24, "ZDICT_fastCover_params_t does not match zdict.h");
+_Static_assert(offsetof(ZDICT_fastCover_params_t, accel) == 32, "ZDICT_fastCover_params_t does not match zdict.h");
+_Static_assert(offsetof(ZDICT_fastCover_params_t, zParams) == 44, "ZDICT_fastCover_params_t does not match zdict.h");
+_Static_assert(sizeof(ZDICT_fastCover_params_t) == 56, "ZDICT_fastCover_params_t does not match zdict.h");
+#endif
+
+size_t ZDICT_optimizeTrainFromBuffer_fastCover(void* dictBuffer, size_t dictBufferCapacity,
+	const void* samplesBuffer, const size_t* samplesSizes, unsigned nbSamples,
+	ZDICT_fastCover_params_t* parameters);
+unsigned ZDICT_isError(size_t errorCode);
+const char* ZDICT_getErrorName(size_t errorCode);
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// trainFastCover trains a dictionary into dictionary from the concatenated
+// samples with the zstd --train defaults, returning its size.
+func trainFastCover(dictionary, samples []byte, sizes []int, o trainOptions) (int, error) {
+	sampleSizes := make([]C.size_t, len(sizes))
+	for i, size := range sizes {
+		sampleSizes[i] = C.size_t(size)
+	}
+	// Search for the segment size, as zstd --train does
+	params := C.ZDICT_fastCover_params_t{
+		d:          8,
+		f:          20,
+		steps:      4,
+		nbThreads:  C.unsigned(max(o.threads, 1)),
+		splitPoint: 0.75,
+		accel:      1,
+		zParams: C.ZDICT_params_t{
+			compressionLevel: C.int(o.level),
+			dictID:           C.unsigned(o.zstdId),
+		},
+	}
+	n := C.ZDICT_optimizeTrainFromBuffer_fastCover(
+		unsafe.Pointer(&dictionary[0]), C.size_t(len(dictionary)),
+		unsafe.Pointer(&samples[0]), &sampleSizes[0], C.unsigned(len(sampleSizes)),
+		&params,
+	)
+	if C.ZDICT_isError(n) != 0 {
+		return 0, errors.New(C.GoString(C.ZDICT_getErrorName(n)))
+	}
+	return int(n), nil
+}
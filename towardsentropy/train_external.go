@@ -0,0 +1,55 @@
+//go:build external_libzstd
+
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+// Built with the external_libzstd tag, github.com/DataDog/zstd links the system
+// zstd, whose zdict.h declares the ZDICT functions.
+
+/*
+#cgo pkg-config: libzstd
+#define ZDICT_STATIC_LINKING_ONLY
+#include <zdict.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// trainFastCover trains a dictionary into dictionary from the concatenated
+// samples with the zstd --train defaults, returning its size.
+func trainFastCover(dictionary, samples []byte, sizes []int, o trainOptions) (int, error) {
+	sampleSizes := make([]C.size_t, len(sizes))
+	for i, size := range sizes {
+		sampleSizes[i] = C.size_t(size)
+	}
+	// Search for the segment size, as zstd --train does
+	params := C.ZDICT_fastCover_params_t{
+		d:          8,
+		f:          20,
+		steps:      4,
+		nbThreads:  C.unsigned(max(o.threads, 1)),
+		splitPoint: 0.75,
+		accel:      1,
+		zParams: C.ZDICT_params_t{
+			compressionLevel: C.int(o.level),
+			dictID:           C.unsigned(o.zstdId),
+		},
+	}
+	n := C.ZDICT_optimizeTrainFromBuffer_fastCover(
+		unsafe.Pointer(&dictionary[0]), C.size_t(len(dictionary)),
+		unsafe.Pointer(&samples[0]), &sampleSizes[0], C.unsigned(len(sampleSizes)),
+		&params,
+	)
+	if C.ZDICT_isError(n) != 0 {
+		return 0, errors.New(C.GoString(C.ZDICT_getErrorName(n)))
+	}
+	return int(n), nil
+}
@@ -0,0 +1,70 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestTrainDictionary(t *testing.T) {
+	body, err := os.ReadFile("../testdata/files/supply_chain/SupplyChainGHGEmissionFactors_v1.2_NAICS_byGHG_USD2021.csv")
+	if err != nil {
+		t.Fatalf("Could not read file: %v", err)
+	}
+	dictBytes, err := TrainDictionary(SplitSamples(body, 1024), 16*1024, WithZstdId(40000), WithTrainingThreads(2))
+	if err != nil {
+		t.Fatalf("Could not train: %v", err)
+	}
+	if len(dictBytes) == 0 || len(dictBytes) > 16*1024 {
+		t.Fatalf("Unexpected dictionary size %d", len(dictBytes))
+	}
+	addDictionary(Dictionary{Id: "trained", Bytes: dictBytes})
+	defer delete(dictionaries, "trained")
+	if id := getDictionary("trained").ZstdId(); id != 40000 {
+		t.Errorf("Expected zstd id 40000, got %d", id)
+	}
+
+	sample := body[len(body)/2 : len(body)/2+2000]
+	var plain, trained, out bytes.Buffer
+	Compress(bytes.NewReader(sample), &plain, "")
+	if err := Compress(bytes.NewReader(sample), &trained, "trained"); err != nil {
+		t.Fatalf("Could not compress with the trained dictionary: %v", err)
+	}
+	if trained.Len() >= plain.Len() {
+		t.Errorf("Expected the trained dictionary to beat plain zstd: %d >= %d", trained.Len(), plain.Len())
+	}
+	if err := Decompress(&trained, &out, "trained"); err != nil || !bytes.Equal(out.Bytes(), sample) {
+		t.Errorf("Could not round trip with the trained dictionary: %v", err)
+	}
+}
+
+func TestTrainDictionaryErrors(t *testing.T) {
+	if _, err := TrainDictionary(nil, 1024); err == nil {
+		t.Errorf("Expected an error without samples")
+	}
+	if _, err := TrainDictionary([][]byte{[]byte("too little")}, 1024); err == nil {
+		t.Errorf("Expected an error training on too little data")
+	}
+	if _, err := TrainDictionary([][]byte{[]byte("sample")}, 0); err == nil {
+		t.Errorf("Expected an error for a zero size")
+	}
+}
+
+func TestSplitSamples(t *testing.T) {
+	samples := SplitSamples([]byte("abcdefgh"), 3)
+	if len(samples) != 3 || string(samples[0]) != "abc" || string(samples[2]) != "gh" {
+		t.Errorf("Unexpected samples %q", samples)
+	}
+	if samples = SplitSamples([]byte("abc"), 0); len(samples) != 1 {
+		t.Errorf("Expected one sample without a block size, got %q", samples)
+	}
+	if samples = SplitSamples(nil, 3); len(samples) != 0 {
+		t.Errorf("Expected no samples from no data, got %q", samples)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// WithTranscoding has the handler decode responses the wrapped handler encoded
+// with gzip or deflate and compress them like plain responses, instead of
+// forwarding them untouched. A strong ETag on such a response is made weak.
+// Other encodings, such as br, are still forwarded untouched, as are responses
+// known to have no body: HEAD, 204, 304 and Content-Length 0. When a body
+// cannot be decoded the response is aborted with http.ErrAbortHandler.
+func WithTranscoding() HandlerOption {
+	return func(h *TowardsEntropyHandler) {
+		h.transcode = true
+	}
+}
+
+// WithGzipRequests has the handler encode decompressed request bodies with gzip
+// before the wrapped handler reads them, for upstreams that understand gzip but
+// not zstd.
+func WithGzipRequests() HandlerOption {
+	return func(h *TowardsEntropyHandler) {
+		h.gzipRequests = true
+	}
+}
+
+func transcodable(encoding string) bool {
+	return encoding == "gzip" || encoding == "deflate"
+}
+
+// transcoder decodes a gzip or deflate body written to it into dst. Decoding
+// runs on its own goroutine, reading from a pipe the response is written to.
+type transcoder struct {
+	pw   *io.PipeWriter
+	dst  *countingWriter
+	done chan error
+}
+
+func newTranscoder(encoding string, dst io.Writer) *transcoder {
+	pr, pw := io.Pipe()
+	t := &transcoder{pw: pw, dst: &countingWriter{Writer: dst}, done: make(chan error, 1)}
+	go func() {
+		err := decodeContent(encoding, pr, t.dst)
+		// Fail writes still to come when the body could not be decoded
+		pr.CloseWithError(err)
+		t.done <- err
+	}()
+	return t
+}
+
+func (t *transcoder) Write(b []byte) (int, error) {
+	return t.pw.Write(b)
+}
+
+// close waits for the body to be decoded, reporting whether it was valid.
+func (t *transcoder) close() error {
+	t.pw.Close()
+	return <-t.done
+}
+
+// abort stops decoding a body that will not be finished and waits for the
+// decoding goroutine, so it no longer writes to the encoder.
+func (t *transcoder) abort() {
+	t.pw.CloseWithError(http.ErrAbortHandler)
+	<-t.done
+}
+
+func decodeContent(encoding string, r io.Reader, w io.Writer) error {
+	var decoder io.ReadCloser
+	var err error
+	if encoding == "gzip" {
+		decoder, err = gzip.NewReader(r)
+	} else {
+		decoder, err = zlib.NewReader(r)
+	}
+	if err == io.EOF {
+		// An empty body stays empty
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	_, err = io.Copy(w, decoder)
+	return err
+}
+
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// gzipBody compresses a request body with gzip as it is read.
+type gzipBody struct {
+	*io.PipeReader
+	source io.ReadCloser
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func newGzipBody(source io.ReadCloser) *gzipBody {
+	pr, pw := io.Pipe()
+	g := &gzipBody{PipeReader: pr, source: source, done: make(chan struct{})}
+	go func() {
+		defer close(g.done)
+		gw := gzip.NewWriter(pw)
+		_, err := io.Copy(gw, source)
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return g
+}
+
+// Close stops the compressing goroutine, waits for it to stop reading and
+// closes the source. Closing again does nothing.
+func (g *gzipBody) Close() error {
+	g.once.Do(func() {
+		g.PipeReader.Close()
+		<-g.done
+		g.err = g.source.Close()
+	})
+	return g.err
+}
@@ -0,0 +1,208 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package towardsentropy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func encodedHandler(encoding string, body []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var encoded bytes.Buffer
+		var ew io.WriteCloser
+		if encoding == "gzip" {
+			ew = gzip.NewWriter(&encoded)
+		} else {
+			ew = zlib.NewWriter(&encoded)
+		}
+		ew.Write(body)
+		ew.Close()
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write(encoded.Bytes())
+	})
+}
+
+func TestTranscodeResponse(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	body := getBody()
+
+	for _, encoding := range []string{"gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			var completion Completion
+			handler := NewTowardsEntropyHandler(encodedHandler(encoding, body), WithTranscoding(),
+				WithCompletionFunc(func(r *http.Request, c Completion) { completion = c }))
+			rr := executeRequest(handler, "GET", "/data.csv", []string{"zstd", "szstd"}, []string{"supply_chain"}, t)
+
+			checkStatus(rr, http.StatusOK, t)
+			checkHeader(rr, "Content-Encoding", string(SharedZstd), t)
+			checkHeader(rr, "ETag", `W/"v1"`, t)
+			checkBody("supply_chain", rr, string(body), t)
+			if completion.ResponseBytesIn != int64(len(body)) {
+				t.Errorf("Expected %d decoded bytes in, got %d", len(body), completion.ResponseBytesIn)
+			}
+		})
+	}
+}
+
+func TestTranscodeDisabled(t *testing.T) {
+	InitWithStruct(Config{DictionaryDirectory: StrPtr("../testdata/dictionaries")})
+	handler := NewTowardsEntropyHandler(encodedHandler("gzip", []byte("hello")))
+	rr := executeRequest(handler, "GET", "/", []string{"zstd"}, []string{}, t)
+	checkHeader(rr, "Content-Encoding", "gzip", t)
+	checkHeader(rr, "ETag", `"v1"`, t)
+}
+
+func TestTranscodeCorruptResponse(t *testing.T) {
+	InitWithStruct(Config{DictionaryDirectory: StrPtr("../testdata/dictionaries")})
+	server := httptest.NewServer(NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write([]byte("not gzip at all"))
+	}), WithTranscoding()))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept-Encoding", string(Zstd))
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("Expected the response to be aborted")
+	}
+}
+
+func TestTranscodeEmptyResponse(t *testing.T) {
+	// HEAD requests reach the wrapped handler
+	InitWithStruct(Config{DictionaryDirectory: StrPtr("../testdata/dictionaries"), HandleHeadRequests: BoolPtr(false)})
+	defer InitWithStruct(Config{HandleHeadRequests: BoolPtr(true)})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/length" {
+			w.Header().Set("Content-Length", "0")
+		}
+	}), WithTranscoding())
+
+	// HEAD and a zero Content-Length are known to have no body, and are forwarded
+	for _, tt := range []struct{ method, path string }{{"HEAD", "/"}, {"GET", "/length"}} {
+		rr := executeRequest(handler, tt.method, tt.path, []string{"zstd"}, []string{}, t)
+		checkStatus(rr, http.StatusOK, t)
+		checkHeader(rr, "Content-Encoding", "gzip", t)
+		if rr.Body.Len() != 0 {
+			t.Errorf("Expected no body for %s %s, got %d bytes", tt.method, tt.path, rr.Body.Len())
+		}
+	}
+
+	// Without a length the empty body is decoded as empty rather than aborted
+	rr := executeRequest(handler, "GET", "/", []string{"zstd"}, []string{}, t)
+	checkStatus(rr, http.StatusOK, t)
+	checkHeader(rr, "Content-Encoding", string(Zstd), t)
+	checkBody("", rr, "", t)
+}
+
+func TestTranscodeAbortedResponse(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	var encoded bytes.Buffer
+	gw := gzip.NewWriter(&encoded)
+	gw.Write(getBody())
+	gw.Close()
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		// Like a reverse proxy whose upstream fails mid body
+		w.Write(encoded.Bytes()[:encoded.Len()/2])
+		panic(http.ErrAbortHandler)
+	}), WithTranscoding())
+
+	before := runtime.NumGoroutine()
+	func() {
+		defer func() {
+			if recovered := recover(); recovered != http.ErrAbortHandler {
+				t.Errorf("Expected the panic to reach the server, got %v", recovered)
+			}
+		}()
+		executeRequest(handler, "GET", "/data.csv", []string{"zstd"}, []string{}, t)
+	}()
+
+	// The decoding goroutine is waited for, allow others to wind down
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected the decoding goroutine to exit, %d goroutines before and %d after", before, after)
+	}
+}
+
+func TestGzipRequests(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+	})
+	body := getBody()
+	var received []byte
+	var encoding string
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("Expected a gzip body: %v", err)
+			return
+		}
+		received, _ = io.ReadAll(gr)
+	}), WithGzipRequests())
+
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(body), &compressed, "supply_chain")
+	req := httptest.NewRequest(http.MethodPost, "/upload", &compressed)
+	req.Header.Set("Content-Encoding", string(SharedZstd))
+	req.Header.Set("Dictionary-Id", "supply_chain")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if encoding != "gzip" {
+		t.Errorf("Expected Content-Encoding gzip, got %q", encoding)
+	}
+	if !bytes.Equal(received, body) {
+		t.Errorf("Expected the gzip body to decode to the original")
+	}
+}
+
+func TestGzipRequestsUnread(t *testing.T) {
+	InitWithStruct(Config{DictionaryDirectory: StrPtr("../testdata/dictionaries")})
+	handler := NewTowardsEntropyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}), WithGzipRequests())
+
+	var compressed bytes.Buffer
+	Compress(bytes.NewReader(getBody()), &compressed, "")
+	before := runtime.NumGoroutine()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &compressed)
+	req.Header.Set("Content-Encoding", string(Zstd))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Expected the gzip goroutine to exit, %d goroutines before and %d after", before, after)
+	}
+}
@@ -11,31 +11,40 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-
-	"github.com/DataDog/zstd"
+	"time"
 )
 
 var errNoDictionaryFound = fmt.Errorf("no dictionary found")
 
 type TowardsEntropyTransport struct {
-	base   http.RoundTripper
-	config internalConfig
-	logger Logger
+	base        http.RoundTripper
+	config      internalConfig
+	logger      Logger
+	passthrough bool
 }
 
-func NewTowardsEntropyTransport(base http.RoundTripper) *TowardsEntropyTransport {
+func NewTowardsEntropyTransport(base http.RoundTripper, opts ...TransportOption) *TowardsEntropyTransport {
 	config := getConfig()
 	if base == nil {
 		base = http.DefaultTransport
 	}
-	return &TowardsEntropyTransport{
+	t := &TowardsEntropyTransport{
 		base:   base,
 		config: config,
-		logger: Logger{config.LogLevel},
+		logger: newLogger(config),
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
+	return t
 }
 
 func (t *TowardsEntropyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if compressionDisabledInContext(req.Context()) {
+		t.logger.DebugContext(req.Context(), "Compression disabled for request by context", "url", req.URL.String())
+		return t.base.RoundTrip(req)
+	}
+
 	if req.Method == http.MethodGet || req.Method == http.MethodHead {
 		return t.roundTripRead(req)
 	} else if req.Method == http.MethodPost || req.Method == http.MethodPut || req.Method == http.MethodPatch {
@@ -46,16 +55,40 @@ func (t *TowardsEntropyTransport) RoundTrip(req *http.Request) (*http.Response,
 }
 
 func (t *TowardsEntropyTransport) roundTripRead(req *http.Request) (*http.Response, error) {
-	t.addReadHeaders(req)
+	passthrough := t.passthroughFor(req)
+	if passthrough && req.Header.Get("Accept-Encoding") != "" {
+		t.logger.DebugContext(req.Context(), "Keeping negotiation headers of request", "url", req.URL.String())
+	} else {
+		t.addReadHeaders(req)
+	}
 	resp, err := t.base.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
-	resp.Body = t.newDecompressedReader(resp)
+	encoding := resp.Header.Get("Content-Encoding")
+	if encoding != string(Zstd) && encoding != string(SharedZstd) {
+		return resp, nil
+	}
+	ContextCompressionTrace(req.Context()).dictionarySelected(DictionarySelectedInfo{
+		Encoding:     CompressionType(encoding),
+		DictionaryId: resp.Header.Get("Dictionary-Id"),
+	})
+	if passthrough {
+		t.logger.DebugContext(req.Context(), "Passing compressed response through", "encoding", encoding, "dictionary_id", resp.Header.Get("Dictionary-Id"), "url", req.URL.String())
+		return resp, nil
+	}
+	resp.Body = t.newDecompressedReader(req, resp)
+	// The encoding headers stay for callers that log them
+	resp.Uncompressed = true
 	return resp, nil
 }
 
 func (t *TowardsEntropyTransport) addReadHeaders(req *http.Request) {
+	if dictionaryId, ok := dictionaryFromContext(req.Context()); ok {
+		t.addReadForcedDictionaryHeaders(req, dictionaryId)
+		return
+	}
+
 	dictionaries := findMatchingDictionaries(req, &t.config)
 	if len(dictionaries) == 0 {
 		t.addReadNonDictionaryHeaders(req)
@@ -69,25 +102,42 @@ func (t *TowardsEntropyTransport) addReadHeaders(req *http.Request) {
 	}
 }
 
+func (t *TowardsEntropyTransport) addReadForcedDictionaryHeaders(req *http.Request, dictionaryId string) {
+	if dictionaryId == "" {
+		t.addReadNonDictionaryHeaders(req)
+		return
+	}
+
+	t.logger.DebugContext(req.Context(), "Context forces dictionary", "dictionary_id", dictionaryId, "url", req.URL.String())
+	req.Header.Add("Accept-Encoding", string(SharedZstd))
+	req.Header.Add("Accept-Encoding", string(Zstd))
+	req.Header.Set("Available-Dictionary", dictionaryId)
+	req.Header.Set("Dictionary-Id", dictionaryId)
+}
+
 func (t *TowardsEntropyTransport) addReadNonDictionaryHeaders(req *http.Request) *Dictionary {
 	req.Header.Set("Accept-Encoding", string(Zstd))
 	return nil
 }
 
-func (t *TowardsEntropyTransport) newDecompressedReader(resp *http.Response) io.ReadCloser {
+func (t *TowardsEntropyTransport) newDecompressedReader(req *http.Request, resp *http.Response) io.ReadCloser {
+	trace := ContextCompressionTrace(req.Context())
 	encoding := resp.Header.Get("Content-Encoding")
 	if encoding == string(Zstd) {
-		return zstd.NewReader(resp.Body)
+		return newMeteredReadCloser(newContextReadCloser(req.Context(), resp.Body), sourceTransport, "", trace, newPlainDecoder)
 	} else if encoding == string(SharedZstd) {
 		dictionaryId := resp.Header.Get("Dictionary-Id")
 		dictionary := getDictionary(dictionaryId)
 		if dictionary == nil {
-			t.logger.Error("No dictionary found for response")
+			t.logger.ErrorContext(req.Context(), "No dictionary found for response", "dictionary_id", dictionaryId, "url", req.URL.String())
+			defaultMetrics.recordFallback(sourceTransport, "response_dictionary_not_loaded")
 			// TODO error handle, this would be BAD!
-			return zstd.NewReader(resp.Body)
+			return newMeteredReadCloser(newContextReadCloser(req.Context(), resp.Body), sourceTransport, "", trace, newPlainDecoder)
 		}
-		t.logger.Debugf("Using dictionary %s", dictionary.Id)
-		return zstd.NewReaderDict(resp.Body, dictionary.Bytes)
+		t.logger.DebugContext(req.Context(), "Decompressing response", "encoding", SharedZstd, "dictionary_id", dictionary.Id, "url", req.URL.String())
+		return newMeteredReadCloser(newContextReadCloser(req.Context(), resp.Body), sourceTransport, dictionary.Id, trace, func(r io.Reader) io.ReadCloser {
+			return newDecoder(r, dictionary)
+		})
 	} else {
 		return resp.Body
 	}
@@ -95,24 +145,56 @@ func (t *TowardsEntropyTransport) newDecompressedReader(resp *http.Response) io.
 
 func (t *TowardsEntropyTransport) roundTripWrite(req *http.Request) (*http.Response, error) {
 	if req.Body == nil {
-		t.logger.Debug("No body in write request, skipping compression")
+		t.logger.DebugContext(req.Context(), "No body in write request, skipping compression", "url", req.URL.String())
+		return t.base.RoundTrip(req)
+	}
+	if encoding := req.Header.Get("Content-Encoding"); encoding != "" && t.passthroughFor(req) {
+		t.logger.DebugContext(req.Context(), "Passing encoded request body through", "encoding", encoding, "url", req.URL.String())
 		return t.base.RoundTrip(req)
 	}
 
 	dictionaryId, err := t.getDictionaryId(req)
 	if err != nil && err != errNoDictionaryFound {
-		t.logger.Errorf("Error getting dictionary id: %v", err)
+		t.logger.ErrorContext(req.Context(), "Error getting dictionary id", "error", err, "url", req.URL.String())
+		defaultMetrics.recordError(sourceTransport, "negotiate")
 		return nil, err
 	}
 	dictionary := getDictionary(dictionaryId)
+	if dictionary == nil && dictionaryId != "" {
+		if _, forced := dictionaryFromContext(req.Context()); forced {
+			defaultMetrics.recordError(sourceTransport, "negotiate")
+			return nil, fmt.Errorf("dictionary with id '%s' not found", dictionaryId)
+		}
+		// A preflight or match rule may name a dictionary this side has not loaded
+		t.logger.WarnContext(req.Context(), "Dictionary not loaded, compressing without one", "dictionary_id", dictionaryId, "url", req.URL.String())
+		defaultMetrics.recordFallback(sourceTransport, "dictionary_not_loaded")
+		dictionaryId = ""
+	}
+	defaultMetrics.recordNegotiation(sourceTransport, dictionaryId)
+	trace := ContextCompressionTrace(req.Context())
+	encoding := encodingFor(dictionaryId)
+	trace.dictionarySelected(DictionarySelectedInfo{Encoding: encoding, DictionaryId: dictionaryId})
 
+	start := time.Now()
+	trace.compressStart(CompressStartInfo{Encoding: encoding, DictionaryId: dictionaryId, Level: t.compressionLevel(req)})
+	body := &countingReadCloser{ReadCloser: req.Body}
+	req.Body = body
 	var compressedBuffer bytes.Buffer
-	t.logger.Debugf("Compressing request with dictionary '%s'", dictionaryId)
-	err = t.compress(req.Body, &compressedBuffer, dictionary)
+	err = t.compress(req, &compressedBuffer, dictionary)
+	trace.compressDone(CompressDoneInfo{
+		Encoding:     encoding,
+		DictionaryId: dictionaryId,
+		BytesIn:      body.count,
+		BytesOut:     int64(compressedBuffer.Len()),
+		Elapsed:      time.Since(start),
+		Err:          err,
+	})
 	if err != nil {
 		// TODO consider error cases here
+		defaultMetrics.recordError(sourceTransport, "compress")
 		return nil, err
 	}
+	defaultMetrics.recordCompress(sourceTransport, dictionaryId, body.count, int64(compressedBuffer.Len()), time.Since(start))
 
 	req.Body = io.NopCloser(bytes.NewReader(compressedBuffer.Bytes()))
 	if (dictionaryId) == "" {
@@ -122,13 +204,31 @@ func (t *TowardsEntropyTransport) roundTripWrite(req *http.Request) (*http.Respo
 		req.Header.Set("Content-Encoding", string(SharedZstd))
 	}
 	req.ContentLength = int64(compressedBuffer.Len())
-	t.logger.Debugf("Making request with content length %d", req.ContentLength)
+	t.logger.DebugContext(req.Context(), "Making request",
+		"url", req.URL.String(),
+		"encoding", req.Header.Get("Content-Encoding"),
+		"dictionary_id", dictionaryId,
+		"bytes_in", body.count,
+		"bytes_out", req.ContentLength,
+	)
 	return t.base.RoundTrip(req)
 }
 
 func (t *TowardsEntropyTransport) getDictionaryId(req *http.Request) (string, error) {
+	if dictionaryId, ok := dictionaryFromContext(req.Context()); ok {
+		t.logger.DebugContext(req.Context(), "Context forces dictionary", "dictionary_id", dictionaryId, "url", req.URL.String())
+		return dictionaryId, nil
+	}
 	if t.requiresPreflight(req) {
-		return t.getDictionaryIdViaPreflight(req)
+		trace := ContextCompressionTrace(req.Context())
+		trace.preflightStart(PreflightStartInfo{URL: req.URL.String()})
+		dictionaryId, err := t.getDictionaryIdViaPreflight(req)
+		if err == errNoDictionaryFound {
+			trace.preflightDone(PreflightDoneInfo{})
+		} else {
+			trace.preflightDone(PreflightDoneInfo{DictionaryId: dictionaryId, Err: err})
+		}
+		return dictionaryId, err
 	}
 	return t.getDictionaryIdUnsafe(req)
 }
@@ -159,6 +259,7 @@ func (t *TowardsEntropyTransport) getDictionaryIdViaPreflight(req *http.Request)
 		return "", err
 	}
 	if resp.Header.Get("Dictionary-Id") == "" {
+		defaultMetrics.recordFallback(sourceTransport, "preflight_no_dictionary")
 		return "", errNoDictionaryFound
 	}
 	dictionaryId := resp.Header.Get("Dictionary-Id")
@@ -168,7 +269,8 @@ func (t *TowardsEntropyTransport) getDictionaryIdViaPreflight(req *http.Request)
 func (t *TowardsEntropyTransport) getDictionaryIdUnsafe(req *http.Request) (string, error) {
 	dictionaries := findMatchingDictionaries(req, &t.config)
 	if len(dictionaries) == 0 {
-		t.logger.Debug("No matching dictionaries found for request")
+		t.logger.DebugContext(req.Context(), "No matching dictionaries found for request", "url", req.URL.String())
+		defaultMetrics.recordFallback(sourceTransport, "no_matching_dictionary")
 		return "", errNoDictionaryFound
 	}
 	return dictionaries[0], nil
@@ -193,45 +295,21 @@ func findMatchingDictionaries(req *http.Request, config *internalConfig) []strin
 	return matchingIds
 }
 
-func (t *TowardsEntropyTransport) compress(r io.Reader, w io.Writer, dict *Dictionary) error {
-	config := getConfig()
+func (t *TowardsEntropyTransport) compressionLevel(req *http.Request) int {
+	if level, ok := levelFromContext(req.Context()); ok {
+		return level
+	}
+	return t.config.CompressionLevel
+}
 
-	var zw *zstd.Writer
+func (t *TowardsEntropyTransport) compress(req *http.Request, w io.Writer, dict *Dictionary) error {
+	config := t.config
+	config.CompressionLevel = t.compressionLevel(req)
 	if dict == nil {
-		t.logger.Debug("Compressing request with no dictionary")
-		zw = zstd.NewWriterLevel(w, config.CompressionLevel)
+		t.logger.DebugContext(req.Context(), "Compressing request", "encoding", Zstd, "url", req.URL.String())
 	} else {
-		t.logger.Debugf("Compressing request with dictionary '%s'", dict.Id)
-		zw = zstd.NewWriterLevelDict(w, config.CompressionLevel, dict.Bytes)
-	}
-	defer zw.Close()
-	return t.streamCompress(r, zw)
-}
-
-func (t *TowardsEntropyTransport) streamCompress(r io.Reader, zw *zstd.Writer) error {
-	t.logger.Debug("Streaming compressing request")
-	buf := make([]byte, t.config.BufferSize)
-	for {
-		n, err := r.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("error reading response body: %v", err)
-		}
-
-		_, err = zw.Write(buf[:n])
-		if err != nil {
-			return fmt.Errorf("error compressing and writing data: %v", err)
-		}
+		t.logger.DebugContext(req.Context(), "Compressing request", "encoding", SharedZstd, "dictionary_id", dict.Id, "url", req.URL.String())
 	}
-
-	// Flush any unwritten data to the underlying writer
-	err := zw.Flush()
-	if err != nil {
-		return fmt.Errorf("error flushing remaining data: %v", err)
-	}
-
-	t.logger.Debug("Done streaming compression")
-	return nil
+	_, err := compress(req.Context(), req.Body, w, dict, config)
+	return err
 }
@@ -8,6 +8,8 @@ package towardsentropy
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -269,6 +271,26 @@ func TestTransportBodyDictPreflight(t *testing.T) {
 	}
 }
 
+func TestTransportCanceled(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		PreflightWrites:     BoolPtr(false),
+	})
+	transport := NewTowardsEntropyTransport(&MockRoundTripper{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com", bytes.NewReader(getBody()))
+	if err != nil {
+		t.Fatalf("Could not create HTTP request: %v", err)
+	}
+
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
 func getBody() []byte {
 	content, err := os.ReadFile("../testdata/files/supply_chain/SupplyChainGHGEmissionFactors_v1.2_NAICS_byGHG_USD2021_chunk_9.csv")
 	if err != nil {
@@ -290,3 +312,45 @@ func areSlicesEqual(a, b []byte) bool {
 	}
 	return true
 }
+
+func TestTransportPreflightDictionaryNotLoaded(t *testing.T) {
+	InitWithStruct(Config{
+		DictionaryDirectory: StrPtr("../testdata/dictionaries"),
+		DictionaryMatchMap:  MapPtr(map[string]string{"*": "supply_chain"}),
+		PreflightWrites:     BoolPtr(true),
+		CompressionLevel:    IntPtr(3),
+	})
+	body := getBody()
+	var compressedBuffer bytes.Buffer
+	if err := Compress(bytes.NewReader(body), &compressedBuffer, ""); err != nil {
+		t.Fatalf("Could not compress body: %v", err)
+	}
+	base := &MockRoundTripper{
+		expectedBody:    compressedBuffer.Bytes(),
+		expectedHeaders: &map[string]string{"Content-Encoding": "zstd"},
+		preflightResponse: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Dictionary-Id": []string{"server_only"}},
+		},
+	}
+	transport := NewTowardsEntropyTransport(base)
+	// The transport keeps the level it was created with
+	InitWithStruct(Config{CompressionLevel: IntPtr(19)})
+	defer InitWithStruct(Config{CompressionLevel: IntPtr(5)})
+
+	level := 0
+	ctx := WithCompressionTrace(context.Background(), &CompressionTrace{
+		OnCompressStart: func(info CompressStartInfo) { level = info.Level },
+	})
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "http://example.com", bytes.NewReader(body))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Expected a plain zstd fallback, got %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+	if level != 3 {
+		t.Errorf("Expected the transport's level 3, got %d", level)
+	}
+}
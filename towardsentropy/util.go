@@ -7,18 +7,264 @@
 package towardsentropy
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/DataDog/zstd"
 )
 
+// zstdResponseWriter compresses a response, adding headers when the response
+// starts. A response that already has a Content-Encoding is taken to be encoded
+// and is forwarded untouched.
 type zstdResponseWriter struct {
 	http.ResponseWriter
-	Writer *zstd.Writer
+	Writer        *zstd.Writer
+	ctx           context.Context
+	headers       http.Header // Encoding headers for a compressed response
+	written       int64
+	elapsed       time.Duration
+	wroteHeader   bool
+	passthrough   bool
+	partial       bool        // Whether the response is a range, sent uncompressed
+	transcode     bool        // Whether gzip and deflate responses are decoded and compressed
+	head          bool        // Whether the request is HEAD, so the response has no body
+	transcoder    *transcoder // Decoder for a response being transcoded
+	compressing   bool        // Whether the response is being compressed
+	trace         *CompressionTrace
+	compressStart CompressStartInfo // Passed to the trace once compressing starts
 }
 
+func (z *zstdResponseWriter) WriteHeader(code int) {
+	if z.wroteHeader {
+		z.ResponseWriter.WriteHeader(code)
+		return
+	}
+	z.wroteHeader = true
+	header := z.Header()
+	encoding := header.Get("Content-Encoding")
+	// A compressed partial body could not be joined to the rest of a download, so
+	// ranges go out on the uncompressed representation. Handlers that ignore
+	// Range and answer with the full body are still compressed.
+	if code == http.StatusPartialContent || header.Get("Content-Range") != "" {
+		z.partial = true
+		z.passthrough = true
+		z.ResponseWriter.WriteHeader(code)
+		return
+	}
+	// Responses known to have no body are left as they are
+	empty := z.head || code == http.StatusNoContent || code == http.StatusNotModified || header.Get("Content-Length") == "0"
+	if z.transcode && transcodable(encoding) && !empty {
+		header.Del("Content-Encoding")
+		weakenETag(header)
+		z.transcoder = newTranscoder(encoding, z.Writer)
+		encoding = ""
+	}
+	if encoding != "" || code == http.StatusNoContent || code == http.StatusNotModified {
+		z.passthrough = true
+	} else {
+		z.compressing = true
+		z.trace.compressStart(z.compressStart)
+		for k, v := range z.headers {
+			header[k] = v
+		}
+		// Any length set by the wrapped handler is the uncompressed length
+		header.Del("Content-Length")
+	}
+	z.ResponseWriter.WriteHeader(code)
+}
+
+// Write stops compressing once the request context is done, so a handler that
+// checks write errors stops work as soon as the client goes away.
 func (z *zstdResponseWriter) Write(b []byte) (int, error) {
-	return z.Writer.Write(b)
+	if err := z.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if !z.wroteHeader {
+		z.WriteHeader(http.StatusOK)
+	}
+	if z.passthrough {
+		n, err := z.ResponseWriter.Write(b)
+		z.written += int64(n)
+		return n, err
+	}
+	start := time.Now()
+	if z.transcoder != nil {
+		// The transcoder counts the decoded bytes
+		n, err := z.transcoder.Write(b)
+		z.elapsed += time.Since(start)
+		return n, err
+	}
+	n, err := z.Writer.Write(b)
+	z.elapsed += time.Since(start)
+	z.written += int64(n)
+	return n, err
+}
+
+// finishTranscoding waits for a transcoded body to be compressed.
+func (z *zstdResponseWriter) finishTranscoding() error {
+	if z.transcoder == nil {
+		return nil
+	}
+	err := z.transcoder.close()
+	z.written = z.transcoder.dst.count
+	z.transcoder = nil
+	return err
+}
+
+// abortTranscoding stops decoding a response the wrapped handler did not finish.
+func (z *zstdResponseWriter) abortTranscoding() {
+	if z.transcoder == nil {
+		return
+	}
+	z.transcoder.abort()
+	z.written = z.transcoder.dst.count
+	z.transcoder = nil
+}
+
+// Flush sends what has been compressed so far, so streamed responses such as
+// server-sent events reach the client as they are written. Transcoded
+// responses are not flushed.
+func (z *zstdResponseWriter) Flush() {
+	if !z.wroteHeader {
+		z.WriteHeader(http.StatusOK)
+	}
+	if z.transcoder != nil {
+		// The transcoder writes on its own goroutine until the body ends
+		return
+	}
+	if !z.passthrough {
+		z.Writer.Flush()
+	}
+	if flusher, ok := z.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// contextReadCloser fails reads with ctx.Err() once ctx is done.
+type contextReadCloser struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+func newContextReadCloser(ctx context.Context, r io.ReadCloser) *contextReadCloser {
+	return &contextReadCloser{ReadCloser: r, ctx: ctx}
+}
+
+func (c *contextReadCloser) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.ReadCloser.Read(b)
+}
+
+// countingReadCloser counts the bytes read through it and the time spent reading them.
+type countingReadCloser struct {
+	io.ReadCloser
+	count   int64
+	elapsed time.Duration
+}
+
+func (c *countingReadCloser) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := c.ReadCloser.Read(b)
+	c.elapsed += time.Since(start)
+	c.count += int64(n)
+	return n, err
+}
+
+// meteredReadCloser records decompression metrics and trace events for a body
+// once it is exhausted or closed.
+type meteredReadCloser struct {
+	decompressed *countingReadCloser
+	compressed   *countingReadCloser
+	source       string
+	dictionaryId string
+	trace        *CompressionTrace
+	once         sync.Once
+}
+
+func newMeteredReadCloser(
+	body io.ReadCloser,
+	source, dictionaryId string,
+	trace *CompressionTrace,
+	newReader func(io.Reader) io.ReadCloser,
+) *meteredReadCloser {
+	trace.decompressStart(DecompressStartInfo{Encoding: encodingFor(dictionaryId), DictionaryId: dictionaryId})
+	compressed := &countingReadCloser{ReadCloser: body}
+	return &meteredReadCloser{
+		decompressed: &countingReadCloser{ReadCloser: newReader(compressed)},
+		compressed:   compressed,
+		source:       source,
+		dictionaryId: dictionaryId,
+		trace:        trace,
+	}
+}
+
+func (m *meteredReadCloser) Read(b []byte) (int, error) {
+	n, err := m.decompressed.Read(b)
+	if err == io.EOF {
+		m.record()
+	} else if err != nil {
+		m.once.Do(func() {
+			defaultMetrics.recordError(m.source, "decompress")
+			m.trace.decompressError(DecompressErrorInfo{Encoding: encodingFor(m.dictionaryId), DictionaryId: m.dictionaryId, Err: err})
+		})
+	}
+	return n, err
+}
+
+// Close closes both the decompressing reader and the body it reads from.
+func (m *meteredReadCloser) Close() error {
+	m.record()
+	err := m.decompressed.Close()
+	if closeErr := m.compressed.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (m *meteredReadCloser) record() {
+	m.once.Do(func() {
+		defaultMetrics.recordDecompress(m.source, m.dictionaryId, m.compressed.count, m.decompressed.count, m.decompressed.elapsed)
+		m.trace.decompressDone(DecompressDoneInfo{
+			Encoding:     encodingFor(m.dictionaryId),
+			DictionaryId: m.dictionaryId,
+			BytesIn:      m.compressed.count,
+			BytesOut:     m.decompressed.count,
+			Elapsed:      m.decompressed.elapsed,
+		})
+	})
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	c.count += int64(n)
+	return n, err
+}
+
+// headerTokens splits the comma separated values of a header, dropping
+// parameters such as q-values, so "zstd, szstd;q=0.9" and two separate
+// headers give the same tokens.
+func headerTokens(header http.Header, name string) []string {
+	tokens := make([]string, 0)
+	for _, value := range header.Values(name) {
+		for _, token := range strings.Split(value, ",") {
+			token, _, _ = strings.Cut(token, ";")
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
 }
 
 func contains(slice []string, value string) bool {